@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	gmux "github.com/larryprice/go-for-web-dev/Godeps/_workspace/src/github.com/gorilla/mux"
+)
+
+// The templates and static files are compiled into the binary so that it can
+// run from any directory.
+//
+//go:embed templates public
+var embeddedAssets embed.FS
+
+// assets is where templates and static files are read from: the embedded
+// copy, or the assets.dir setting during development.
+var assets fs.FS = embeddedAssets
+
+// assetHashes maps a file below public/ to a hash of its content. The hash
+// goes into asset URLs so that browsers can cache them forever.
+var assetHashes struct {
+	sync.RWMutex
+	m map[string]string
+}
+
+func initAssets() {
+	if cfg.AssetDir != "" {
+		assets = os.DirFS(cfg.AssetDir)
+	}
+	if err := hashAssets(); err != nil {
+		logger.Error("reading static assets failed", "error", err.Error())
+		os.Exit(1)
+	}
+}
+
+func hashAssets() error {
+	m := map[string]string{}
+	err := fs.WalkDir(assets, "public", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(assets, p)
+		if err != nil {
+			return err
+		}
+		m[p[len("public/"):]] = sha256Hex(data)[:16]
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	assetHashes.Lock()
+	assetHashes.m = m
+	assetHashes.Unlock()
+	return nil
+}
+
+func assetHash(name string) string {
+	assetHashes.RLock()
+	defer assetHashes.RUnlock()
+	return assetHashes.m[name]
+}
+
+// assetURL returns the versioned URL of a file below public/. Templates use it
+// as {{asset `js/app.js`}}.
+func assetURL(name string) string {
+	return "/assets/" + name + "?v=" + assetHash(name)
+}
+
+func serveAsset(w http.ResponseWriter, r *http.Request) {
+	name := path.Clean(gmux.Vars(r)["name"])
+	hash := assetHash(name)
+	if hash == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	etag := `"` + hash + `"`
+	if r.FormValue("v") == hash {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=0, must-revalidate")
+	}
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	data, err := fs.ReadFile(assets, "public/"+name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(data))
+}
+
+func registerAssetRoutes(mux *router) {
+	mux.HandleFunc("/assets/{name:.+}", serveAsset).Methods("GET", "HEAD")
+}
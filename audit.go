@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	gmux "github.com/larryprice/go-for-web-dev/Godeps/_workspace/src/github.com/gorilla/mux"
+	"github.com/larryprice/go-for-web-dev/Godeps/_workspace/src/gopkg.in/gorp.v1"
+)
+
+// systemActor is recorded for changes made by background jobs.
+const systemActor = "system"
+
+// AuditEntry is a row of the append-only audit log. Entries are only ever
+// inserted.
+type AuditEntry struct {
+	PK     int64  `db:"pk"`
+	At     int64  `db:"at"`
+	Actor  string `db:"actor"`
+	Action string `db:"action"`
+	BookPK int64  `db:"book_pk"`
+	Detail string `db:"detail"`
+}
+
+type AuditPage struct {
+	Entries []AuditEntry
+	Filter  AuditFilter
+	User    string
+	Theme   string
+}
+
+type AuditFilter struct {
+	Actor  string
+	Action string
+	BookPK int64
+	Since  string
+	Until  string
+}
+
+func recordAudit(exec gorp.SqlExecutor, actor, action string, bookPK int64, detail string) error {
+	return exec.Insert(&AuditEntry{
+		At:     time.Now().Unix(),
+		Actor:  actor,
+		Action: action,
+		BookPK: bookPK,
+		Detail: detail,
+	})
+}
+
+// The Book hooks below write the audit entry and queue webhooks through the
+// executor making the change. createBook, updateBook and deleteBook run a
+// single-book change in a transaction so that those rows commit or roll back
+// together with it.
+
+func createBook(b *Book) error {
+	return inTransaction(func(tx *gorp.Transaction) error {
+		return tx.Insert(b)
+	})
+}
+
+func updateBook(b *Book) error {
+	return inTransaction(func(tx *gorp.Transaction) error {
+		_, err := tx.Update(b)
+		return err
+	})
+}
+
+func deleteBook(b *Book) error {
+	return inTransaction(func(tx *gorp.Transaction) error {
+		_, err := tx.Delete(b)
+		return err
+	})
+}
+
+func inTransaction(fn func(tx *gorp.Transaction) error) error {
+	tx, err := dbmap.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (b *Book) actor() string {
+	if b.Actor != "" {
+		return b.Actor
+	}
+	return b.User
+}
+
+func (b *Book) PostInsert(s gorp.SqlExecutor) error {
+	if err := recordAudit(s, b.actor(), "book.create", b.PK, b.Title); err != nil {
+		return err
+	}
+	return queueWebhooks(s, "book.create", b)
+}
+
+// PreUpdate remembers the stored row so PostUpdate can describe the change.
+func (b *Book) PreUpdate(s gorp.SqlExecutor) error {
+	var old Book
+	if err := s.SelectOne(&old, "select * from books where pk="+dbmap.Dialect.BindVar(0), b.PK); err != nil {
+		return err
+	}
+	b.previous = &old
+	return nil
+}
+
+func (b *Book) PostUpdate(s gorp.SqlExecutor) error {
+	action, detail := "book.update", ""
+	if old := b.previous; old != nil {
+		if old.DeletedAt == 0 && b.DeletedAt != 0 {
+			action = "book.trash"
+		} else if old.DeletedAt != 0 && b.DeletedAt == 0 {
+			action = "book.restore"
+		} else {
+			detail = bookChanges(old, b)
+		}
+		b.previous = nil
+	}
+	if err := recordAudit(s, b.actor(), action, b.PK, detail); err != nil {
+		return err
+	}
+	return queueWebhooks(s, action, b)
+}
+
+func (b *Book) PostDelete(s gorp.SqlExecutor) error {
+	if err := recordAudit(s, b.actor(), "book.delete", b.PK, b.Title); err != nil {
+		return err
+	}
+	return queueWebhooks(s, "book.delete", b)
+}
+
+func (u *User) PostInsert(s gorp.SqlExecutor) error {
+	return recordAudit(s, u.Username, "user.register", 0, "")
+}
+
+// bookChanges lists the user-visible fields that differ between two versions
+// of a book.
+func bookChanges(old, cur *Book) string {
+	var changed []string
+	if old.Title != cur.Title {
+		changed = append(changed, "title")
+	}
+	if old.Author != cur.Author {
+		changed = append(changed, "author")
+	}
+	if old.Classification != cur.Classification {
+		changed = append(changed, "classification")
+	}
+	if old.LCC != cur.LCC {
+		changed = append(changed, "lcc")
+	}
+	if old.CallNumberOverride != cur.CallNumberOverride {
+		changed = append(changed, "call number")
+	}
+	if old.ISBN != cur.ISBN {
+		changed = append(changed, "isbn")
+	}
+	if old.Cover != cur.Cover {
+		changed = append(changed, "cover")
+	}
+	return strings.Join(changed, ", ")
+}
+
+// isAdmin reports whether username is listed in the comma-separated admins
+// setting.
+func isAdmin(username string) bool {
+	for _, admin := range strings.Split(cfg.Admins, ",") {
+		if username != "" && strings.TrimSpace(admin) == username {
+			return true
+		}
+	}
+	return false
+}
+
+func getAuditEntries(entries *[]AuditEntry, f AuditFilter, w http.ResponseWriter) bool {
+	var where []string
+	var args []interface{}
+	bind := func(cond string, arg interface{}) {
+		where = append(where, cond+dbmap.Dialect.BindVar(len(args)))
+		args = append(args, arg)
+	}
+
+	if f.Actor != "" {
+		bind("actor=", f.Actor)
+	}
+	if f.Action != "" {
+		bind("action like ", f.Action+"%")
+	}
+	if f.BookPK != 0 {
+		bind("book_pk=", f.BookPK)
+	}
+	if t, err := time.Parse("2006-01-02", f.Since); err == nil {
+		bind("at>=", t.Unix())
+	}
+	if t, err := time.Parse("2006-01-02", f.Until); err == nil {
+		bind("at<", t.AddDate(0, 0, 1).Unix())
+	}
+
+	q := "select * from audit_log"
+	if len(where) > 0 {
+		q += " where " + strings.Join(where, " and ")
+	}
+	if _, err := dbmap.Select(entries, q+" order by pk desc limit 500", args...); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+func registerAuditRoutes(mux *router) {
+	mux.HandleFunc("/books/{pk:[0-9]+}/history", func(w http.ResponseWriter, r *http.Request) {
+		pk, _ := strconv.ParseInt(gmux.Vars(r)["pk"], 10, 64)
+		// A book's history stays available while it is in the trash.
+		var b Book
+		if err := selectUserBook(&b, pk, getStringFromSession(r, "User"), ""); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		entries := []AuditEntry{}
+		if !getAuditEntries(&entries, AuditFilter{BookPK: pk}, w) {
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(entries); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}).Methods("GET")
+
+	mux.HandleFunc("/admin/audit", func(w http.ResponseWriter, r *http.Request) {
+		p := AuditPage{Entries: []AuditEntry{}, User: getStringFromSession(r, "User")}
+		p.Theme = getPreferences(p.User).Theme
+		if !isAdmin(p.User) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		p.Filter.Actor = r.FormValue("actor")
+		p.Filter.Action = r.FormValue("action")
+		p.Filter.BookPK, _ = strconv.ParseInt(r.FormValue("book"), 10, 64)
+		p.Filter.Since = r.FormValue("since")
+		p.Filter.Until = r.FormValue("until")
+		if !getAuditEntries(&p.Entries, p.Filter, w) {
+			return
+		}
+
+		if r.FormValue("format") == "json" {
+			if err := json.NewEncoder(w).Encode(p.Entries); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		renderTemplate(w, "audit", p)
+	}).Methods("GET")
+}
+
+func formatUnix(t int64) string {
+	return time.Unix(t, 0).UTC().Format("2006-01-02 15:04:05")
+}
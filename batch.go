@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	maxBatchSize = 50
+	maxBatchBody = 64 << 10
+)
+
+// BatchRequest lists the works to add, by OCLC work ID and/or by ISBN.
+type BatchRequest struct {
+	IDs   []string
+	ISBNs []string
+}
+
+// BatchResult reports what happened to a single item of a batch.
+type BatchResult struct {
+	Input  string
+	Status string // "added", "duplicate" or "error"
+	Error  string `json:",omitempty"`
+	Book   *Book  `json:",omitempty"`
+
+	oclc string
+}
+
+// resolveBatch looks every item up in the catalog using a bounded pool of
+// workers. Results keep the order of the request, IDs first.
+func resolveBatch(ctx context.Context, req BatchRequest, username string) []BatchResult {
+	type job struct {
+		index int
+		input string
+		isbn  bool
+	}
+
+	var jobs []job
+	for _, id := range req.IDs {
+		jobs = append(jobs, job{len(jobs), strings.TrimSpace(id), false})
+	}
+	for _, isbn := range req.ISBNs {
+		jobs = append(jobs, job{len(jobs), strings.TrimSpace(isbn), true})
+	}
+
+	results := make([]BatchResult, len(jobs))
+	queue := make(chan job)
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.BatchWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range queue {
+				results[j.index] = resolveBatchItem(ctx, j.input, j.isbn, username)
+			}
+		}()
+	}
+	for _, j := range jobs {
+		queue <- j
+	}
+	close(queue)
+	wg.Wait()
+
+	return results
+}
+
+func resolveBatchItem(ctx context.Context, input string, byISBN bool, username string) BatchResult {
+	res := BatchResult{Input: input}
+
+	var book ClassifyBookResponse
+	var isbn string
+	var err error
+	if byISBN {
+		if isbn, err = normalizeISBN(input); err == nil {
+			book, err = findByISBN(ctx, isbn)
+		}
+	} else {
+		book, err = find(ctx, input)
+	}
+	if err != nil {
+		res.Status, res.Error = "error", err.Error()
+		return res
+	}
+
+	res.Book = &Book{
+		PK:             -1,
+		Title:          book.BookData.Title,
+		Author:         book.BookData.Author,
+		Classification: book.Classification.MostPopular,
+		LCC:            book.LCC.MostPopular,
+		Year:           book.BookData.Year,
+		ID:             book.BookData.ID,
+		User:           username,
+		ISBN:           isbn,
+	}
+	res.oclc = book.BookData.OCLC
+	return res
+}
+
+// insertBatch adds every resolved book in one transaction. Works the user
+// already owns, or that appear twice in the batch, are reported as duplicates.
+func insertBatch(results []BatchResult) error {
+	tx, err := dbmap.Begin()
+	if err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	for i := range results {
+		res := &results[i]
+		if res.Book == nil {
+			continue
+		}
+
+		existing, err := findExistingBook(tx, res.Book.ID, res.Book.User)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if existing != nil || seen[res.Book.ID] {
+			res.Status = "duplicate"
+			if existing != nil {
+				res.Book = existing
+			}
+			continue
+		}
+
+		if err = tx.Insert(res.Book); err != nil {
+			tx.Rollback()
+			return err
+		}
+		seen[res.Book.ID] = true
+		res.Status = "added"
+	}
+
+	return tx.Commit()
+}
+
+func registerBatchRoutes(mux *router) {
+	mux.HandleFunc("/books/batch", func(w http.ResponseWriter, r *http.Request) {
+		var req BatchRequest
+		r.Body = http.MaxBytesReader(w, r.Body, maxBatchBody)
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if n := len(req.IDs) + len(req.ISBNs); n == 0 || n > maxBatchSize {
+			http.Error(w, "A batch must contain between 1 and "+strconv.Itoa(maxBatchSize)+" items",
+				http.StatusBadRequest)
+			return
+		}
+
+		// Leave time to insert and answer before the server's write timeout;
+		// items still being looked up then are reported as errors.
+		ctx, cancel := context.WithTimeout(r.Context(), cfg.WriteTimeout*3/4)
+		defer cancel()
+		results := resolveBatch(ctx, req, getStringFromSession(r, "User"))
+		if err := insertBatch(results); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var added []BatchResult
+		for _, res := range results {
+			if res.Status == "added" {
+				b := *res.Book
+				added = append(added, BatchResult{Book: &b, oclc: res.oclc})
+			}
+		}
+		go func() {
+			for _, res := range added {
+				fetchCover(res.Book, res.oclc)
+			}
+		}()
+
+		if err := json.NewEncoder(w).Encode(results); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}).Methods("POST")
+}
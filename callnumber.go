@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	gmux "github.com/larryprice/go-for-web-dev/Godeps/_workspace/src/github.com/gorilla/mux"
+)
+
+// Classification schemes a user can shelve by.
+const (
+	schemeDewey = "ddc"
+	schemeLCC   = "lcc"
+)
+
+// primaryClass returns the classification of b in the given scheme.
+func primaryClass(b *Book, scheme string) string {
+	if scheme == schemeLCC {
+		return b.LCC
+	}
+	return b.Classification
+}
+
+// callNumber returns the complete call number of b in the given scheme:
+// the class, an author mark and the year, e.g. "813.54 K56s 1986" or
+// "PS3561.I483 1986". A call number set by the user wins.
+func callNumber(b *Book, scheme string) string {
+	if b.CallNumberOverride != "" {
+		return b.CallNumberOverride
+	}
+
+	class := strings.TrimSpace(primaryClass(b, scheme))
+	if class == "" {
+		return ""
+	}
+
+	var parts []string
+	if scheme == schemeLCC {
+		// The provider's LCC usually already ends in a Cutter for the
+		// author; add one only when it stops at the class number.
+		if p, ok := parseLCC(class); ok && len(p.Rest) == 0 {
+			if mark := lcCutter(authorSurname(b.Author)); mark != "" {
+				class += "." + mark
+			}
+		}
+		parts = append(parts, class)
+	} else {
+		if n, ok := deweyNumber(class); ok {
+			class = n
+		}
+		parts = append(parts, class)
+		if mark := cutterSanborn(authorSurname(b.Author)); mark != "" {
+			parts = append(parts, mark+workMark(b.Title))
+		}
+	}
+	if b.Year != "" {
+		parts = append(parts, b.Year)
+	}
+	return strings.Join(parts, " ")
+}
+
+// setCallNumbers fills in the call number of every book.
+func setCallNumbers(books []Book, scheme string) {
+	for i := range books {
+		books[i].CallNumber = callNumber(&books[i], scheme)
+	}
+}
+
+// compareDewey orders Dewey call numbers. The integer part of the class
+// always has three digits, so classes compare correctly as strings; the
+// author mark and year are compared after them. Anything that does not start
+// with a Dewey number sorts last.
+func compareDewey(a, b string) int {
+	na, okA := deweyNumber(a)
+	nb, okB := deweyNumber(b)
+	switch {
+	case okA != okB:
+		if okA {
+			return -1
+		}
+		return 1
+	case !okA:
+		return strings.Compare(a, b)
+	case na != nb:
+		return strings.Compare(na, nb)
+	}
+
+	restA := strings.Fields(strings.TrimPrefix(strings.TrimSpace(a), na))
+	restB := strings.Fields(strings.TrimPrefix(strings.TrimSpace(b), nb))
+	for i := 0; i < len(restA) && i < len(restB); i++ {
+		if c := compareCallToken(restA[i], restB[i]); c != 0 {
+			return c
+		}
+	}
+	return len(restA) - len(restB)
+}
+
+// lccPattern splits an LC call number such as "QA76.73.G63 D66 2016" into
+// its class letters, class number and the remaining Cutters and dates.
+var lccPattern = regexp.MustCompile(`^([A-Z]{1,3})\s*(\d+(?:\.\d+)?)?(.*)$`)
+
+var lccTokenPattern = regexp.MustCompile(`[A-Z]+\d*|\d+`)
+
+type lccParts struct {
+	Class  string
+	Number string
+	Rest   []string
+}
+
+func parseLCC(s string) (lccParts, bool) {
+	m := lccPattern.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(s)))
+	if m == nil {
+		return lccParts{}, false
+	}
+	return lccParts{m[1], m[2], lccTokenPattern.FindAllString(m[3], -1)}, true
+}
+
+// compareLCC orders LC call numbers: class letters alphabetically, the class
+// number numerically (QA9 before QA76), Cutters as decimal fractions (.G63
+// before .G7) and dates numerically.
+func compareLCC(a, b string) int {
+	pa, okA := parseLCC(a)
+	pb, okB := parseLCC(b)
+	switch {
+	case okA != okB:
+		if okA {
+			return -1
+		}
+		return 1
+	case !okA:
+		return strings.Compare(a, b)
+	}
+
+	if c := strings.Compare(pa.Class, pb.Class); c != 0 {
+		return c
+	}
+	if c := compareDecimal(pa.Number, pb.Number); c != 0 {
+		return c
+	}
+	for i := 0; i < len(pa.Rest) && i < len(pb.Rest); i++ {
+		if c := compareCallToken(pa.Rest[i], pb.Rest[i]); c != 0 {
+			return c
+		}
+	}
+	return len(pa.Rest) - len(pb.Rest)
+}
+
+// compareCallToken compares a Cutter ("G63") or a date ("2016"). Cutter
+// digits are a decimal fraction, so they compare as strings. Dates come
+// before Cutters.
+func compareCallToken(a, b string) int {
+	digitsA := a[0] >= '0' && a[0] <= '9'
+	digitsB := b[0] >= '0' && b[0] <= '9'
+	switch {
+	case digitsA && digitsB:
+		return compareDecimal(a, b)
+	case digitsA != digitsB:
+		if digitsA {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// compareDecimal compares two non-negative decimal numbers given as strings,
+// without the rounding of a float conversion. An empty string sorts first.
+func compareDecimal(a, b string) int {
+	intA, fracA, _ := strings.Cut(a, ".")
+	intB, fracB, _ := strings.Cut(b, ".")
+	intA = strings.TrimLeft(intA, "0")
+	intB = strings.TrimLeft(intB, "0")
+	if len(intA) != len(intB) {
+		return len(intA) - len(intB)
+	}
+	if c := strings.Compare(intA, intB); c != 0 {
+		return c
+	}
+	return strings.Compare(fracA, fracB)
+}
+
+// authorSurname picks the first author's surname out of a Classify author
+// string such as "King, Stephen, 1947- | Wrightson, Bernie".
+func authorSurname(author string) string {
+	first, _, _ := strings.Cut(author, "|")
+	first = strings.TrimSpace(first)
+	if surname, _, ok := strings.Cut(first, ","); ok {
+		return surname
+	}
+	if fields := strings.Fields(first); len(fields) > 0 {
+		return fields[len(fields)-1]
+	}
+	return ""
+}
+
+// cutterLetters lowercases s and keeps only the letters a to z.
+func cutterLetters(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' {
+			r += 'a' - 'A'
+		}
+		if r < 'a' || r > 'z' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// workMark is the lowercase first letter of the title, skipping a leading
+// article, appended to a Cutter-Sanborn number to tell an author's works
+// apart.
+func workMark(title string) string {
+	words := strings.Fields(strings.ToLower(title))
+	if len(words) > 1 && (words[0] == "a" || words[0] == "an" || words[0] == "the") {
+		words = words[1:]
+	}
+	if len(words) == 0 {
+		return ""
+	}
+	letters := cutterLetters(words[0])
+	return letters[:min(1, len(letters))]
+}
+
+// cutterRule maps the letters following a name's initial to a digit of the
+// LC Cutter table: the rule with the greatest prefix not after the letters
+// applies.
+type cutterRule struct {
+	Prefix string
+	Digit  byte
+}
+
+var (
+	lcCutterVowel     = []cutterRule{{"a", '2'}, {"d", '3'}, {"l", '4'}, {"n", '5'}, {"p", '6'}, {"r", '7'}, {"s", '8'}, {"u", '9'}}
+	lcCutterS         = []cutterRule{{"a", '2'}, {"ch", '3'}, {"e", '4'}, {"h", '5'}, {"m", '6'}, {"t", '7'}, {"u", '8'}, {"w", '9'}}
+	lcCutterQu        = []cutterRule{{"a", '3'}, {"e", '4'}, {"i", '5'}, {"o", '6'}, {"r", '7'}, {"t", '8'}, {"y", '9'}}
+	lcCutterConsonant = []cutterRule{{"a", '3'}, {"e", '4'}, {"i", '5'}, {"o", '6'}, {"r", '7'}, {"u", '8'}, {"y", '9'}}
+	lcCutterExpansion = []cutterRule{{"a", '3'}, {"e", '4'}, {"i", '5'}, {"m", '6'}, {"p", '7'}, {"t", '8'}, {"w", '9'}}
+)
+
+func cutterDigit(rules []cutterRule, letters string) byte {
+	digit := rules[0].Digit
+	for _, r := range rules {
+		if letters >= r.Prefix {
+			digit = r.Digit
+		}
+	}
+	return digit
+}
+
+// lcCutter builds a two-digit Cutter number from the Library of Congress
+// Cutter table, e.g. "S65" for Smith.
+func lcCutter(name string) string {
+	s := cutterLetters(name)
+	if len(s) < 2 {
+		return strings.ToUpper(s)
+	}
+
+	mark := []byte{s[0] - 'a' + 'A'}
+	rest := s[1:]
+	switch {
+	case strings.IndexByte("aeiou", s[0]) >= 0:
+		mark = append(mark, cutterDigit(lcCutterVowel, rest))
+	case s[0] == 's':
+		mark = append(mark, cutterDigit(lcCutterS, rest))
+		if strings.HasPrefix(rest, "ch") {
+			// "ch" is a single unit, so the expansion follows it.
+			rest = rest[1:]
+		}
+	case s[0] == 'q' && rest[0] == 'u':
+		rest = rest[1:]
+		if rest == "" {
+			return string(mark) + "8"
+		}
+		mark = append(mark, cutterDigit(lcCutterQu, rest))
+	case s[0] == 'q':
+		mark = append(mark, '2')
+	default:
+		mark = append(mark, cutterDigit(lcCutterConsonant, rest))
+	}
+	if len(rest) > 1 {
+		mark = append(mark, cutterDigit(lcCutterExpansion, rest[1:]))
+	}
+	return string(mark)
+}
+
+// cutterTable holds the Cutter-Sanborn three-figure table loaded from the
+// callnumbers.cutter_table file, sorted by name.
+var cutterTable []cutterEntry
+
+type cutterEntry struct {
+	Name   string
+	Number string
+}
+
+// initCallNumbers loads the Cutter-Sanborn table, a text file with one
+// "name number" pair per line such as "King 527". The table is not
+// distributable, so without one Dewey call numbers use LC Cutter numbers,
+// which is worth a warning when anyone shelves by Dewey.
+func initCallNumbers() {
+	if cfg.CutterTable == "" {
+		n, err := countDeweyUsers()
+		if err == nil && n > 0 {
+			logger.Warn("no Cutter-Sanborn table configured, Dewey call numbers use LC Cutter numbers instead",
+				"setting", "callnumbers.cutter_table", "dewey_users", n)
+		}
+		return
+	}
+	f, err := os.Open(cfg.CutterTable)
+	if err != nil {
+		logger.Error("loading the Cutter-Sanborn table failed", "error", err.Error())
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		if _, err := strconv.Atoi(fields[1]); err != nil {
+			continue
+		}
+		cutterTable = append(cutterTable, cutterEntry{cutterLetters(fields[0]), fields[1]})
+	}
+	sort.Slice(cutterTable, func(i, j int) bool { return cutterTable[i].Name < cutterTable[j].Name })
+}
+
+// countDeweyUsers counts the users whose primary scheme is Dewey, taking it
+// from their preferences and, like getPreferences, from the users table for
+// those who have never saved any.
+func countDeweyUsers() (int64, error) {
+	q := "select count(*) from users u left join preferences p on p.username=u.username" +
+		" where (p.username is not null and p.scheme=" + dbmap.Dialect.BindVar(0) + ")" +
+		" or (p.username is null and u.scheme<>" + dbmap.Dialect.BindVar(1) + ")"
+	return dbmap.SelectInt(q, schemeDewey, schemeLCC)
+}
+
+// cutterSanborn returns the author mark for a surname: its initial and the
+// number of the last table entry not after it, e.g. "K56" for King.
+func cutterSanborn(surname string) string {
+	name := cutterLetters(surname)
+	if name == "" {
+		return ""
+	}
+	if len(cutterTable) == 0 {
+		return lcCutter(name)
+	}
+
+	i := sort.Search(len(cutterTable), func(i int) bool { return cutterTable[i].Name > name })
+	if i == 0 || cutterTable[i-1].Name[0] != name[0] {
+		return lcCutter(name)
+	}
+	return strings.ToUpper(name[:1]) + cutterTable[i-1].Number
+}
+
+func registerCallNumberRoutes(mux *router) {
+	mux.HandleFunc("/books/{pk:[0-9]+}/callnumber", func(w http.ResponseWriter, r *http.Request) {
+		pk, _ := strconv.ParseInt(gmux.Vars(r)["pk"], 10, 64)
+		username := getStringFromSession(r, "User")
+		var b Book
+		if err := getUserBook(&b, pk, username); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		// An empty value goes back to the generated call number.
+		b.CallNumberOverride = strings.TrimSpace(r.FormValue("callNumber"))
+		if len(b.CallNumberOverride) > 64 {
+			http.Error(w, "call number is too long", http.StatusBadRequest)
+			return
+		}
+		if err := updateBook(&b); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		b.CallNumber = callNumber(&b, userScheme(username))
+		if err := json.NewEncoder(w).Encode(b); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}).Methods("PUT")
+}
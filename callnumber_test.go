@@ -0,0 +1,235 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLCC(t *testing.T) {
+	tests := []struct {
+		in   string
+		want lccParts
+		ok   bool
+	}{
+		{"QA76.73.G63 D66 2016", lccParts{"QA", "76.73", []string{"G63", "D66", "2016"}}, true},
+		{"ps3561.i483", lccParts{"PS", "3561", []string{"I483"}}, true},
+		{"PR 6039 .O32", lccParts{"PR", "6039", []string{"O32"}}, true},
+		{"KF", lccParts{"KF", "", nil}, true},
+		{"813.54", lccParts{}, false},
+		{"", lccParts{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseLCC(tt.in)
+		if ok != tt.ok || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseLCC(%q) = %+v, %v, want %+v, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// TestCompareLCC checks call numbers listed in shelf order.
+func TestCompareLCC(t *testing.T) {
+	shelf := []string{
+		"Q172",
+		"QA9.A1",
+		"QA76",
+		"QA76.73",
+		"QA76.73.G63",
+		"QA76.73.G63 D66 2015",
+		"QA76.73.G63 D66 2016",
+		"QA76.73.G7",
+		"QA76.9.A43",
+		"QA761",
+		"QB43",
+		// Anything else follows, in plain string order.
+		"",
+		"813.54",
+	}
+	for i := range shelf {
+		for j := range shelf {
+			got := sign(compareLCC(shelf[i], shelf[j]))
+			if want := sign(i - j); got != want {
+				t.Errorf("compareLCC(%q, %q) = %d, want %d", shelf[i], shelf[j], got, want)
+			}
+		}
+	}
+}
+
+func TestCompareDecimal(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"9", "76", -1},
+		{"76.73", "76.8", -1},
+		{"076", "76", 0},
+		{"", "1", -1},
+		{"100", "99.99", 1},
+	}
+	for _, tt := range tests {
+		if got := sign(compareDecimal(tt.a, tt.b)); got != tt.want {
+			t.Errorf("compareDecimal(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+// TestCompareDewey checks call numbers listed in shelf order.
+func TestCompareDewey(t *testing.T) {
+	shelf := []string{
+		"500",
+		"813",
+		"813.5 K56",
+		"813.54",
+		"813.54 1986",
+		"813.54 K5",
+		"813.54 K56s",
+		"813.54 K56s 1977",
+		"813.54 K56s 1986",
+		"813.54 K6",
+		"813.6",
+		"823.912",
+		// Anything else follows, in plain string order.
+		"B",
+		"FIC",
+	}
+	for i := range shelf {
+		for j := range shelf {
+			got := sign(compareDewey(shelf[i], shelf[j]))
+			if want := sign(i - j); got != want {
+				t.Errorf("compareDewey(%q, %q) = %d, want %d", shelf[i], shelf[j], got, want)
+			}
+		}
+	}
+}
+
+func TestAuthorSurname(t *testing.T) {
+	tests := []struct {
+		author string
+		want   string
+	}{
+		{"King, Stephen, 1947- | Wrightson, Bernie", "King"},
+		{"Le Guin, Ursula K.", "Le Guin"},
+		{"Ursula K. Le Guin", "Guin"},
+		{"Homer", "Homer"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := authorSurname(tt.author); got != tt.want {
+			t.Errorf("authorSurname(%q) = %q, want %q", tt.author, got, tt.want)
+		}
+	}
+}
+
+func TestLCCutter(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"Smith", "S65"},
+		{"King", "K56"},
+		{"Adams", "A33"},
+		{"O'Brien", "O27"},
+		{"Chen", "C44"},
+		{"Schultz", "S38"},
+		{"Quinn", "Q56"},
+		{"Qu", "Q8"},
+		{"Qadir", "Q23"},
+		{"Ng", "N4"},
+		{"X", "X"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := lcCutter(tt.name); got != tt.want {
+			t.Errorf("lcCutter(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCutterSanborn(t *testing.T) {
+	defer func(saved []cutterEntry) { cutterTable = saved }(cutterTable)
+
+	cutterTable = nil
+	if got := cutterSanborn("King"); got != "K56" {
+		t.Errorf("cutterSanborn without a table = %q, want the LC Cutter K56", got)
+	}
+
+	cutterTable = []cutterEntry{{"kin", "526"}, {"king", "527"}, {"kingsl", "545"}, {"smith", "663"}}
+	tests := []struct {
+		surname string
+		want    string
+	}{
+		{"King", "K527"},
+		{"Kingman", "K527"},
+		{"Kingsley", "K545"},
+		{"Kinder", "K526"},
+		{"Smithson", "S663"},
+		// Names before the first entry for their letter fall back to LC.
+		{"Kafka", "K34"},
+		{"Adams", "A33"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := cutterSanborn(tt.surname); got != tt.want {
+			t.Errorf("cutterSanborn(%q) = %q, want %q", tt.surname, got, tt.want)
+		}
+	}
+}
+
+func TestWorkMark(t *testing.T) {
+	tests := []struct {
+		title string
+		want  string
+	}{
+		{"The Shining", "s"},
+		{"A Wizard of Earthsea", "w"},
+		{"It", "i"},
+		{"The", "t"},
+		{"'Salem's Lot", "s"},
+		{"1984", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := workMark(tt.title); got != tt.want {
+			t.Errorf("workMark(%q) = %q, want %q", tt.title, got, tt.want)
+		}
+	}
+}
+
+func TestCallNumber(t *testing.T) {
+	defer func(saved []cutterEntry) { cutterTable = saved }(cutterTable)
+	cutterTable = nil
+
+	shining := Book{
+		Classification: "813/.54",
+		LCC:            "PS3561.I483",
+		Author:         "King, Stephen, 1947-",
+		Title:          "The Shining",
+		Year:           "1977",
+	}
+	tests := []struct {
+		book   Book
+		scheme string
+		want   string
+	}{
+		{shining, schemeDewey, "813.54 K56s 1977"},
+		{shining, schemeLCC, "PS3561.I483 1977"},
+		{Book{LCC: "PS3561", Author: "King, Stephen"}, schemeLCC, "PS3561.K56"},
+		{Book{Classification: "FIC", Author: "King, Stephen", Title: "It"}, schemeDewey, "FIC K56i"},
+		{Book{Author: "King, Stephen", Year: "1977"}, schemeDewey, ""},
+		{Book{Classification: "813.54", CallNumberOverride: "REF 813 KIN"}, schemeDewey, "REF 813 KIN"},
+	}
+	for _, tt := range tests {
+		if got := callNumber(&tt.book, tt.scheme); got != tt.want {
+			t.Errorf("callNumber(%+v, %s) = %q, want %q", tt.book, tt.scheme, got, tt.want)
+		}
+	}
+}
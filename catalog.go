@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Errors returned by the catalog client. Handlers translate them into HTTP
+// status codes with catalogErrorStatus.
+var (
+	errCatalogUnavailable = errors.New("catalog provider is unavailable, try again shortly")
+	errCatalogTimeout     = errors.New("catalog provider timed out")
+)
+
+// catalogBadResponse is returned when the provider answers with something
+// other than a successful XML document.
+type catalogBadResponse struct {
+	Status int
+	Reason string
+}
+
+func (e *catalogBadResponse) Error() string {
+	return fmt.Sprintf("catalog provider returned an invalid response (HTTP %d): %s", e.Status, e.Reason)
+}
+
+// catalogErrorStatus maps an error from the catalog layer onto the status code
+// a handler should answer with.
+func catalogErrorStatus(err error) int {
+	var bad *catalogBadResponse
+	switch {
+	case err == errNotInCatalog:
+		return http.StatusNotFound
+	case err == errCatalogUnavailable:
+		return http.StatusServiceUnavailable
+	case err == errCatalogTimeout:
+		return http.StatusGatewayTimeout
+	case errors.As(err, &bad):
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
+// maxCatalogBackoff caps the wait between retries however many are configured.
+const maxCatalogBackoff = 10 * time.Second
+
+// catalogClient calls the Classify API with a per-request deadline, retries
+// transient failures with jittered exponential backoff and stops calling the
+// provider for a while once it keeps failing.
+type catalogClient struct {
+	BaseURL    string
+	HTTP       *http.Client
+	Timeout    time.Duration
+	MaxRetries int
+	Backoff    time.Duration
+	Breaker    *circuitBreaker
+}
+
+var catalog *catalogClient
+
+func initCatalog() {
+	catalog = &catalogClient{
+		BaseURL:    cfg.CatalogURL,
+		HTTP:       &http.Client{},
+		Timeout:    cfg.CatalogTimeout,
+		MaxRetries: cfg.CatalogRetries,
+		Backoff:    200 * time.Millisecond,
+		Breaker:    &circuitBreaker{Threshold: cfg.CatalogBreakerThreshold, Cooldown: cfg.CatalogBreakerCooldown},
+	}
+}
+
+// Get fetches the Classify document for the given query string, e.g.
+// "owi=123". Only a 200 response with an XML body is returned.
+func (c *catalogClient) Get(ctx context.Context, query string) ([]byte, error) {
+	if !c.Breaker.Allow() {
+		loggerFor(ctx).Warn("catalog circuit open, failing fast", "query", query)
+		catalogRequests.Inc(catalogOutcome(errCatalogUnavailable))
+		return nil, errCatalogUnavailable
+	}
+
+	var body []byte
+	var err error
+	log := loggerFor(ctx)
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		body, err = c.attempt(ctx, c.BaseURL+"?summary=true&"+query)
+		catalogRequests.Inc(catalogOutcome(err))
+		catalogDuration.Observe(time.Since(start).Seconds(), catalogOutcome(err))
+		if err != nil {
+			log.Warn("catalog request failed", "query", query, "attempt", attempt+1,
+				"duration_ms", float64(time.Since(start).Microseconds())/1000, "error", err.Error())
+		} else {
+			log.Info("catalog request", "query", query, "attempt", attempt+1,
+				"duration_ms", float64(time.Since(start).Microseconds())/1000)
+		}
+		if err == nil || !retryable(err) || attempt >= c.MaxRetries || ctx.Err() != nil {
+			break
+		}
+
+		// Full jitter: sleep a random time up to the exponential backoff.
+		wait := time.Duration(rand.Int63n(int64(c.backoff(attempt))))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+		}
+	}
+
+	if ctx.Err() == context.Canceled {
+		// The caller went away; that says nothing about the provider.
+		c.Breaker.Abandon()
+	} else if err != nil && retryable(err) {
+		c.Breaker.Failure()
+	} else {
+		c.Breaker.Success()
+	}
+	return body, err
+}
+
+// Probe makes a single request for readiness checks. It bypasses retries and
+// the circuit breaker, so a failing probe neither waits nor trips the breaker.
+func (c *catalogClient) Probe(ctx context.Context) error {
+	_, err := c.attempt(ctx, c.BaseURL+"?summary=true&stdnbr=0")
+	return err
+}
+
+// backoff is the longest wait after the given failed attempt, doubling from
+// Backoff each time up to maxCatalogBackoff.
+func (c *catalogClient) backoff(attempt int) time.Duration {
+	wait := max(c.Backoff, time.Millisecond)
+	for i := 0; i < attempt && wait < maxCatalogBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, maxCatalogBackoff)
+}
+
+func (c *catalogClient) attempt(ctx context.Context, url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if id := requestLogFrom(ctx).ID; id != "" {
+		req.Header.Set("X-Request-ID", id)
+	}
+	resp, err := c.HTTP.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, classifyTransportError(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, classifyTransportError(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &catalogBadResponse{resp.StatusCode, http.StatusText(resp.StatusCode)}
+	}
+	if !bytes.HasPrefix(bytes.TrimSpace(body), []byte("<?xml")) &&
+		!strings.Contains(resp.Header.Get("Content-Type"), "xml") {
+		return nil, &catalogBadResponse{resp.StatusCode, "not an XML document"}
+	}
+	return body, nil
+}
+
+func classifyTransportError(err error) error {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return errCatalogTimeout
+	}
+	return &catalogBadResponse{0, err.Error()}
+}
+
+// retryable reports whether err is worth another attempt: timeouts, network
+// failures and 5xx responses.
+func retryable(err error) bool {
+	var bad *catalogBadResponse
+	if err == errCatalogTimeout {
+		return true
+	}
+	return errors.As(err, &bad) && (bad.Status == 0 || bad.Status >= 500)
+}
+
+// circuitBreaker opens after Threshold consecutive failures and rejects calls
+// until Cooldown has passed, then lets a single probe through.
+type circuitBreaker struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func (b *circuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.Threshold {
+		return true
+	}
+	if time.Since(b.openedAt) < b.Cooldown || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *circuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.probing = false
+}
+
+func (b *circuitBreaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.probing = false
+	if b.failures >= b.Threshold {
+		b.openedAt = time.Now()
+	}
+}
+
+// Abandon gives up a probe without recording an outcome.
+func (b *circuitBreaker) Abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+}
+
+// Open reports whether calls are currently being rejected.
+func (b *circuitBreaker) Open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.failures >= b.Threshold && time.Since(b.openedAt) < b.Cooldown
+}
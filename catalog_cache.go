@@ -0,0 +1,228 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/larryprice/go-for-web-dev/Godeps/_workspace/src/gopkg.in/gorp.v1"
+)
+
+// errNotInCatalog is returned when the catalog has no match for a lookup.
+// These answers are cached too, for a shorter time.
+var errNotInCatalog = errors.New("no matching work found in the catalog")
+
+// CatalogCacheEntry is a row of the optional persistent cache tier.
+type CatalogCacheEntry struct {
+	Key       string `db:"cache_key"`
+	Value     string `db:"value"`
+	Negative  bool   `db:"negative"`
+	ExpiresAt int64  `db:"expires_at"`
+}
+
+type CatalogCacheStats struct {
+	Entries        int
+	Capacity       int
+	Hits           int64
+	NegativeHits   int64
+	PersistentHits int64
+	Misses         int64
+	Evictions      int64
+	Persistent     bool
+}
+
+// lookupCache sits in front of the catalog provider. It keeps recent answers
+// in an in-memory LRU and, when persistent is set, in the catalog_cache table
+// so they survive restarts.
+type lookupCache struct {
+	mu          sync.Mutex
+	entries     map[string]*list.Element
+	order       *list.List
+	capacity    int
+	ttl         time.Duration
+	negativeTTL time.Duration
+	persistent  bool
+	stats       CatalogCacheStats
+}
+
+type cachedLookup struct {
+	key      string
+	value    []byte
+	negative bool
+	expires  time.Time
+}
+
+var catalogCache = newLookupCache(1000, 24*time.Hour, 10*time.Minute, false)
+
+func newLookupCache(capacity int, ttl, negativeTTL time.Duration, persistent bool) *lookupCache {
+	return &lookupCache{
+		entries:     map[string]*list.Element{},
+		order:       list.New(),
+		capacity:    capacity,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		persistent:  persistent,
+	}
+}
+
+func initCatalogCache() {
+	catalogCache = newLookupCache(cfg.CatalogCacheSize, cfg.CatalogCacheTTL, cfg.CatalogCacheNegativeTTL,
+		cfg.CatalogCachePersist)
+}
+
+// lookup decodes the cached answer for key into dst, calling fetch on a miss.
+// fetch returning errNotInCatalog is cached as a negative answer; any other
+// error is passed through uncached.
+func (c *lookupCache) lookup(key string, dst interface{}, fetch func() (interface{}, error)) error {
+	if e, ok := c.get(key); ok {
+		return c.decode(e, dst)
+	}
+
+	v, err := fetch()
+	if err != nil && err != errNotInCatalog {
+		return err
+	}
+
+	e := cachedLookup{key: key, negative: err == errNotInCatalog}
+	if e.negative {
+		e.expires = time.Now().Add(c.negativeTTL)
+	} else {
+		if e.value, err = json.Marshal(v); err != nil {
+			return err
+		}
+		e.expires = time.Now().Add(c.ttl)
+	}
+	c.put(e)
+	c.store(e)
+	return c.decode(e, dst)
+}
+
+func (c *lookupCache) decode(e cachedLookup, dst interface{}) error {
+	if e.negative {
+		return errNotInCatalog
+	}
+	return json.Unmarshal(e.value, dst)
+}
+
+func (c *lookupCache) get(key string) (cachedLookup, bool) {
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(cachedLookup)
+		if time.Now().Before(e.expires) {
+			c.order.MoveToFront(el)
+			c.countHit(e)
+			c.mu.Unlock()
+			return e, true
+		}
+		c.order.Remove(el)
+		delete(c.entries, key)
+	}
+	c.mu.Unlock()
+
+	if e, ok := c.load(key); ok {
+		c.put(e)
+		c.mu.Lock()
+		c.stats.PersistentHits++
+		c.countHit(e)
+		c.mu.Unlock()
+		return e, true
+	}
+
+	c.mu.Lock()
+	c.stats.Misses++
+	c.mu.Unlock()
+	return cachedLookup{}, false
+}
+
+func (c *lookupCache) countHit(e cachedLookup) {
+	if e.negative {
+		c.stats.NegativeHits++
+	} else {
+		c.stats.Hits++
+	}
+}
+
+func (c *lookupCache) put(e cachedLookup) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[e.key]; ok {
+		el.Value = e
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[e.key] = c.order.PushFront(e)
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(cachedLookup).key)
+		c.stats.Evictions++
+	}
+}
+
+func (c *lookupCache) load(key string) (cachedLookup, bool) {
+	if !c.persistent {
+		return cachedLookup{}, false
+	}
+	obj, err := dbmap.Get(CatalogCacheEntry{}, key)
+	if err != nil || obj == nil {
+		return cachedLookup{}, false
+	}
+	row := obj.(*CatalogCacheEntry)
+	e := cachedLookup{key: key, value: []byte(row.Value), negative: row.Negative, expires: time.Unix(row.ExpiresAt, 0)}
+	return e, time.Now().Before(e.expires)
+}
+
+func (c *lookupCache) store(e cachedLookup) {
+	if !c.persistent {
+		return
+	}
+	row := &CatalogCacheEntry{Key: e.key, Value: string(e.value), Negative: e.negative, ExpiresAt: e.expires.Unix()}
+	err := inTransaction(func(tx *gorp.Transaction) error {
+		n, err := tx.Update(row)
+		if err == nil && n == 0 {
+			err = tx.Insert(row)
+		}
+		return err
+	})
+	if err != nil {
+		logger.Warn("storing a catalog answer in the persistent cache failed", "key", e.key, "error", err.Error())
+	}
+}
+
+// purgeExpired removes expired answers from the persistent tier. Expired
+// entries in memory are replaced when they are next looked up.
+func (c *lookupCache) purgeExpired() error {
+	if !c.persistent {
+		return nil
+	}
+	_, err := dbmap.Exec("delete from catalog_cache where expires_at<"+dbmap.Dialect.BindVar(0), time.Now().Unix())
+	return err
+}
+
+func (c *lookupCache) Stats() CatalogCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := c.stats
+	s.Entries = c.order.Len()
+	s.Capacity = c.capacity
+	s.Persistent = c.persistent
+	return s
+}
+
+func registerCatalogCacheRoutes(mux *router) {
+	mux.HandleFunc("/admin/catalog-cache", func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(getStringFromSession(r, "User")) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(catalogCache.Stats()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}).Methods("GET")
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := &circuitBreaker{Threshold: 2, Cooldown: time.Hour}
+
+	b.Failure()
+	if !b.Allow() || b.Open() {
+		t.Fatal("breaker opened before reaching its threshold")
+	}
+	b.Success()
+	b.Failure()
+	if !b.Allow() {
+		t.Fatal("a success did not reset the failure count")
+	}
+	b.Failure()
+	if b.Allow() || !b.Open() {
+		t.Fatal("breaker did not open at its threshold")
+	}
+
+	// Once the cooldown has passed a single probe is let through.
+	b.openedAt = time.Now().Add(-2 * time.Hour)
+	if b.Open() {
+		t.Error("breaker still open after its cooldown")
+	}
+	if !b.Allow() {
+		t.Fatal("no probe allowed after the cooldown")
+	}
+	if b.Allow() {
+		t.Fatal("a second probe was allowed while the first was in flight")
+	}
+
+	// An abandoned probe frees the slot without closing the circuit.
+	b.Abandon()
+	if !b.Allow() {
+		t.Fatal("no probe allowed after the last one was abandoned")
+	}
+
+	// A failed probe reopens the circuit for another cooldown.
+	b.Failure()
+	if b.Allow() || !b.Open() {
+		t.Fatal("a failed probe did not reopen the breaker")
+	}
+
+	b.openedAt = time.Now().Add(-2 * time.Hour)
+	b.Allow()
+	b.Success()
+	if !b.Allow() || !b.Allow() || b.Open() {
+		t.Fatal("a successful probe did not close the breaker")
+	}
+}
+
+func TestCatalogBackoff(t *testing.T) {
+	c := &catalogClient{Backoff: 200 * time.Millisecond}
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{0, 200 * time.Millisecond},
+		{1, 400 * time.Millisecond},
+		{3, 1600 * time.Millisecond},
+		{6, maxCatalogBackoff},
+		{63, maxCatalogBackoff},
+		{1000, maxCatalogBackoff},
+	}
+	for _, tt := range tests {
+		if got := c.backoff(tt.attempt); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestCatalogGetRetries(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`<?xml version="1.0"?><classify/>`))
+	}))
+	defer srv.Close()
+
+	c := &catalogClient{
+		BaseURL:    srv.URL,
+		HTTP:       srv.Client(),
+		Timeout:    time.Second,
+		MaxRetries: 2,
+		Backoff:    time.Millisecond,
+		Breaker:    &circuitBreaker{Threshold: 1, Cooldown: time.Hour},
+	}
+	if _, err := c.Get(context.Background(), "owi=1"); err != nil {
+		t.Fatalf("Get after two 503s: %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("made %d requests, want 3", calls)
+	}
+	if c.Breaker.Open() {
+		t.Error("breaker opened although the request eventually succeeded")
+	}
+
+	atomic.StoreInt32(&calls, -10)
+	if _, err := c.Get(context.Background(), "owi=1"); catalogErrorStatus(err) != http.StatusBadGateway {
+		t.Errorf("Get after exhausting retries: err = %v, want a bad response", err)
+	}
+	if _, err := c.Get(context.Background(), "owi=1"); err != errCatalogUnavailable {
+		t.Errorf("Get with the breaker open: err = %v, want errCatalogUnavailable", err)
+	}
+}
+
+func TestCatalogProbe(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		http.Error(w, "down", http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	c := &catalogClient{
+		BaseURL:    srv.URL,
+		HTTP:       srv.Client(),
+		Timeout:    time.Second,
+		MaxRetries: 3,
+		Backoff:    time.Millisecond,
+		Breaker:    &circuitBreaker{Threshold: 1, Cooldown: time.Hour},
+	}
+	if err := c.Probe(context.Background()); err == nil {
+		t.Fatal("Probe of a failing provider succeeded")
+	}
+	if calls != 1 {
+		t.Errorf("Probe made %d requests, want 1", calls)
+	}
+	if c.Breaker.Open() {
+		t.Error("a failed probe opened the circuit breaker")
+	}
+}
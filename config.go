@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultSessionSecret is only acceptable in development.
+const defaultSessionSecret = "my-secret-123"
+
+// Config holds every setting of the server. Values come, in increasing order
+// of precedence, from the built-in defaults, a TOML config file, environment
+// variables and command-line flags.
+type Config struct {
+	Env           string
+	DatabaseURL   string
+	SQLitePath    string
+	SessionSecret string
+	Admins        string
+	MetricsToken  string
+
+	Port            string
+	TLSPort         string
+	TLSCertFile     string
+	TLSKeyFile      string
+	RedirectHTTP    bool
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	ShutdownTimeout time.Duration
+
+	CoverStore  string
+	CoverDir    string
+	S3Endpoint  string
+	S3Bucket    string
+	S3Region    string
+	S3AccessKey string
+	S3SecretKey string
+
+	CatalogURL              string
+	CatalogTimeout          time.Duration
+	CatalogRetries          int
+	CatalogBreakerThreshold int
+	CatalogBreakerCooldown  time.Duration
+	CatalogCacheSize        int
+	CatalogCacheTTL         time.Duration
+	CatalogCacheNegativeTTL time.Duration
+	CatalogCachePersist     bool
+
+	TrashRetention time.Duration
+	BatchWorkers   int
+
+	WebhookTimeout     time.Duration
+	WebhookMaxAttempts int
+	WebhookBackoff     time.Duration
+
+	AssetDir string
+
+	CutterTable string
+}
+
+var cfg Config
+
+// setting describes one configuration value: its dotted name, used both as
+// the flag name and as "section.key" in the config file, and the environment
+// variable that sets it.
+type setting struct {
+	Name   string
+	Env    string
+	Secret bool
+
+	value  string
+	source string
+}
+
+// register declares every setting on fs, bound to the fields of c.
+func (c *Config) register(fs *flag.FlagSet) []*setting {
+	var settings []*setting
+	add := func(name, env string, secret bool) {
+		settings = append(settings, &setting{Name: name, Env: env, Secret: secret, source: "default"})
+	}
+
+	fs.StringVar(&c.Env, "env", "development", "development or production")
+	add("env", "ENV", false)
+	fs.StringVar(&c.DatabaseURL, "database.url", "", "Postgres connection URL, used in production")
+	add("database.url", "DATABASE_URL", true)
+	fs.StringVar(&c.SQLitePath, "database.sqlite_path", "dev.db", "SQLite file used in development")
+	add("database.sqlite_path", "SQLITE_PATH", false)
+	fs.StringVar(&c.SessionSecret, "session.secret", defaultSessionSecret, "key signing the session cookie")
+	add("session.secret", "SESSION_SECRET", true)
+	fs.StringVar(&c.Admins, "admins", "", "comma-separated usernames with admin access")
+	add("admins", "ADMINS", false)
+	fs.StringVar(&c.MetricsToken, "metrics.token", "", "bearer token required to scrape /metrics")
+	add("metrics.token", "METRICS_TOKEN", true)
+
+	fs.StringVar(&c.Port, "server.port", "8080", "HTTP port")
+	add("server.port", "PORT", false)
+	fs.StringVar(&c.TLSPort, "server.tls_port", "8443", "HTTPS port, used when a certificate is configured")
+	add("server.tls_port", "TLS_PORT", false)
+	fs.StringVar(&c.TLSCertFile, "server.tls_cert_file", "", "TLS certificate file")
+	add("server.tls_cert_file", "TLS_CERT_FILE", false)
+	fs.StringVar(&c.TLSKeyFile, "server.tls_key_file", "", "TLS private key file")
+	add("server.tls_key_file", "TLS_KEY_FILE", false)
+	fs.BoolVar(&c.RedirectHTTP, "server.redirect_http", true, "redirect HTTP to HTTPS when TLS is on")
+	add("server.redirect_http", "TLS_REDIRECT_HTTP", false)
+	fs.DurationVar(&c.ReadTimeout, "server.read_timeout", 15*time.Second, "")
+	add("server.read_timeout", "READ_TIMEOUT", false)
+	fs.DurationVar(&c.WriteTimeout, "server.write_timeout", 60*time.Second, "")
+	add("server.write_timeout", "WRITE_TIMEOUT", false)
+	fs.DurationVar(&c.IdleTimeout, "server.idle_timeout", 120*time.Second, "")
+	add("server.idle_timeout", "IDLE_TIMEOUT", false)
+	fs.DurationVar(&c.ShutdownTimeout, "server.shutdown_timeout", 30*time.Second, "time to drain requests on shutdown")
+	add("server.shutdown_timeout", "SHUTDOWN_TIMEOUT", false)
+
+	fs.StringVar(&c.CoverStore, "covers.store", "local", "local or s3")
+	add("covers.store", "COVER_STORE", false)
+	fs.StringVar(&c.CoverDir, "covers.dir", "covers", "directory for the local store")
+	add("covers.dir", "COVER_DIR", false)
+	fs.StringVar(&c.S3Endpoint, "covers.s3_endpoint", "", "")
+	add("covers.s3_endpoint", "S3_ENDPOINT", false)
+	fs.StringVar(&c.S3Bucket, "covers.s3_bucket", "", "")
+	add("covers.s3_bucket", "S3_BUCKET", false)
+	fs.StringVar(&c.S3Region, "covers.s3_region", "us-east-1", "")
+	add("covers.s3_region", "S3_REGION", false)
+	fs.StringVar(&c.S3AccessKey, "covers.s3_access_key", "", "")
+	add("covers.s3_access_key", "S3_ACCESS_KEY", true)
+	fs.StringVar(&c.S3SecretKey, "covers.s3_secret_key", "", "")
+	add("covers.s3_secret_key", "S3_SECRET_KEY", true)
+
+	fs.StringVar(&c.CatalogURL, "catalog.url", "http://classify.oclc.org/classify2/Classify", "Classify API endpoint")
+	add("catalog.url", "CATALOG_URL", false)
+	fs.DurationVar(&c.CatalogTimeout, "catalog.timeout", 10*time.Second, "deadline for each catalog request")
+	add("catalog.timeout", "CATALOG_TIMEOUT", false)
+	fs.IntVar(&c.CatalogRetries, "catalog.retries", 2, "retries after a timeout or 5xx")
+	add("catalog.retries", "CATALOG_RETRIES", false)
+	fs.IntVar(&c.CatalogBreakerThreshold, "catalog.breaker_threshold", 5, "failures before the circuit opens")
+	add("catalog.breaker_threshold", "CATALOG_BREAKER_THRESHOLD", false)
+	fs.DurationVar(&c.CatalogBreakerCooldown, "catalog.breaker_cooldown", 30*time.Second, "")
+	add("catalog.breaker_cooldown", "CATALOG_BREAKER_COOLDOWN", false)
+	fs.IntVar(&c.CatalogCacheSize, "catalog.cache_size", 1000, "entries kept in memory")
+	add("catalog.cache_size", "CATALOG_CACHE_SIZE", false)
+	fs.DurationVar(&c.CatalogCacheTTL, "catalog.cache_ttl", 24*time.Hour, "")
+	add("catalog.cache_ttl", "CATALOG_CACHE_TTL", false)
+	fs.DurationVar(&c.CatalogCacheNegativeTTL, "catalog.cache_negative_ttl", 10*time.Minute, "")
+	add("catalog.cache_negative_ttl", "CATALOG_CACHE_NEGATIVE_TTL", false)
+	fs.BoolVar(&c.CatalogCachePersist, "catalog.cache_persist", false, "also cache lookups in the database")
+	add("catalog.cache_persist", "CATALOG_CACHE_PERSIST", false)
+
+	fs.DurationVar(&c.TrashRetention, "trash.retention", 30*24*time.Hour, "how long deleted books are kept")
+	add("trash.retention", "TRASH_RETENTION", false)
+	fs.IntVar(&c.BatchWorkers, "batch.workers", 4, "concurrent catalog lookups per batch")
+	add("batch.workers", "BATCH_WORKERS", false)
+
+	fs.DurationVar(&c.WebhookTimeout, "webhooks.timeout", 10*time.Second, "deadline for each webhook delivery")
+	add("webhooks.timeout", "WEBHOOK_TIMEOUT", false)
+	fs.IntVar(&c.WebhookMaxAttempts, "webhooks.max_attempts", 8, "attempts before a delivery is given up")
+	add("webhooks.max_attempts", "WEBHOOK_MAX_ATTEMPTS", false)
+	fs.DurationVar(&c.WebhookBackoff, "webhooks.backoff", 30*time.Second, "wait before the first retry, doubling after each failure")
+	add("webhooks.backoff", "WEBHOOK_BACKOFF", false)
+
+	fs.StringVar(&c.AssetDir, "assets.dir", "", "serve templates/ and public/ from this directory instead of the binary, reloading on change")
+	add("assets.dir", "ASSET_DIR", false)
+
+	fs.StringVar(&c.CutterTable, "callnumbers.cutter_table", "", "Cutter-Sanborn table file; LC Cutter numbers are used without one")
+	add("callnumbers.cutter_table", "CUTTER_TABLE", false)
+
+	return settings
+}
+
+// loadConfig builds the configuration from the config file (-config or
+// CONFIG_FILE, default config.toml if present), the environment and args.
+func loadConfig(args []string) (Config, []*setting, error) {
+	var c Config
+	fs := flag.NewFlagSet("go-for-web-dev", flag.ContinueOnError)
+	settings := c.register(fs)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "TOML config file")
+
+	// The config file is named on the command line, which is parsed last, so
+	// look for it first.
+	for i, arg := range args {
+		if arg == "-config" || arg == "--config" {
+			if i+1 < len(args) {
+				*configFile = args[i+1]
+			}
+		} else if strings.HasPrefix(arg, "-config=") || strings.HasPrefix(arg, "--config=") {
+			*configFile = arg[strings.Index(arg, "=")+1:]
+		}
+	}
+
+	path, required := *configFile, true
+	if path == "" {
+		path, required = "config.toml", false
+	}
+	if f, err := os.Open(path); err == nil {
+		values, err := parseTOML(f)
+		f.Close()
+		if err != nil {
+			return c, nil, fmt.Errorf("%s: %v", path, err)
+		}
+		for key, v := range values {
+			s := findSetting(settings, key)
+			if s == nil {
+				return c, nil, fmt.Errorf("%s: unknown setting %q", path, key)
+			}
+			if err := fs.Lookup(key).Value.Set(v); err != nil {
+				return c, nil, fmt.Errorf("%s: %s: %v", path, key, err)
+			}
+			s.source = path
+		}
+	} else if required {
+		return c, nil, err
+	}
+
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(s.Env); ok {
+			if err := fs.Lookup(s.Name).Value.Set(v); err != nil {
+				return c, nil, fmt.Errorf("$%s: %v", s.Env, err)
+			}
+			s.source = "$" + s.Env
+		}
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return c, nil, err
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if s := findSetting(settings, f.Name); s != nil {
+			s.source = "-" + f.Name
+		}
+	})
+	for _, s := range settings {
+		s.value = fs.Lookup(s.Name).Value.String()
+	}
+
+	return c, settings, c.validate()
+}
+
+func findSetting(settings []*setting, name string) *setting {
+	for _, s := range settings {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func (c Config) production() bool {
+	return c.Env == "production"
+}
+
+// validate reports every problem with the configuration at once.
+func (c Config) validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.Env == "development" || c.Env == "production", "env must be development or production, not %q", c.Env)
+	if c.production() {
+		check(c.DatabaseURL != "", "database.url is required in production")
+		check(c.SessionSecret != defaultSessionSecret, "session.secret must be changed in production")
+	}
+	check(len(c.SessionSecret) >= 8, "session.secret must be at least 8 characters")
+	for name, port := range map[string]string{"server.port": c.Port, "server.tls_port": c.TLSPort} {
+		n, err := strconv.Atoi(port)
+		check(err == nil && n > 0 && n < 65536, "%s must be a port number, not %q", name, port)
+	}
+	check((c.TLSCertFile == "") == (c.TLSKeyFile == ""), "server.tls_cert_file and server.tls_key_file must be set together")
+	check(c.CoverStore == "local" || c.CoverStore == "s3", "covers.store must be local or s3, not %q", c.CoverStore)
+	if c.CoverStore == "s3" {
+		_, err := url.ParseRequestURI(c.S3Endpoint)
+		check(err == nil, "covers.s3_endpoint must be a URL")
+		check(c.S3Bucket != "" && c.S3AccessKey != "" && c.S3SecretKey != "",
+			"covers.s3_bucket, covers.s3_access_key and covers.s3_secret_key are required for the s3 store")
+	}
+	_, err := url.ParseRequestURI(c.CatalogURL)
+	check(err == nil, "catalog.url must be a URL")
+	check(c.CatalogTimeout > 0, "catalog.timeout must be positive")
+	check(c.CatalogRetries >= 0 && c.CatalogRetries <= 10, "catalog.retries must be between 0 and 10")
+	check(c.CatalogBreakerThreshold > 0, "catalog.breaker_threshold must be positive")
+	check(c.CatalogBreakerCooldown > 0, "catalog.breaker_cooldown must be positive")
+	check(c.CatalogCacheSize > 0, "catalog.cache_size must be positive")
+	check(c.CatalogCacheTTL > 0, "catalog.cache_ttl must be positive")
+	check(c.CatalogCacheNegativeTTL >= 0, "catalog.cache_negative_ttl must not be negative")
+	check(c.TrashRetention > 0, "trash.retention must be positive")
+	check(c.BatchWorkers > 0, "batch.workers must be positive")
+	check(c.WebhookTimeout > 0, "webhooks.timeout must be positive")
+	check(c.WebhookMaxAttempts > 0 && c.WebhookMaxAttempts <= 20, "webhooks.max_attempts must be between 1 and 20")
+	check(c.WebhookBackoff > 0, "webhooks.backoff must be positive")
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// printConfig writes the effective settings as a config file, with secrets
+// redacted and the source of each value in a comment.
+func printConfig(w io.Writer, settings []*setting) {
+	// Top-level keys have to come before the first [section].
+	var ordered []*setting
+	for _, s := range settings {
+		if !strings.Contains(s.Name, ".") {
+			ordered = append(ordered, s)
+		}
+	}
+	for _, s := range settings {
+		if strings.Contains(s.Name, ".") {
+			ordered = append(ordered, s)
+		}
+	}
+
+	section := ""
+	for _, s := range ordered {
+		name := s.Name
+		if i := strings.Index(name, "."); i >= 0 {
+			if name[:i] != section {
+				section = name[:i]
+				fmt.Fprintf(w, "\n[%s]\n", section)
+			}
+			name = name[i+1:]
+		}
+
+		v := s.value
+		if s.Secret && v != "" {
+			v = "[redacted]"
+		}
+		fmt.Fprintf(w, "%s = %s  # %s\n", name, strconv.Quote(v), s.source)
+	}
+}
+
+// parseTOML reads the subset of TOML used by config files: [section]
+// headers, key = value pairs with quoted strings, numbers, booleans or arrays
+// of strings, and # comments. Keys are returned as "section.key".
+func parseTOML(r io.Reader) (map[string]string, error) {
+	values := map[string]string{}
+	section := ""
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("line %d: expected key = value", n)
+		}
+		key := strings.TrimSpace(line[:eq])
+		if section != "" {
+			key = section + "." + key
+		}
+		v, err := parseTOMLValue(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		values[key] = v
+	}
+	return values, scanner.Err()
+}
+
+func stripComment(line string) string {
+	inString := false
+	for i, c := range line {
+		switch {
+		case c == '"' && (i == 0 || line[i-1] != '\\'):
+			inString = !inString
+		case c == '#' && !inString:
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func parseTOMLValue(v string) (string, error) {
+	switch {
+	case strings.HasPrefix(v, `"`):
+		return strconv.Unquote(v)
+	case strings.HasPrefix(v, "["):
+		if !strings.HasSuffix(v, "]") {
+			return "", errors.New("unterminated array")
+		}
+		var items []string
+		for _, item := range strings.Split(v[1:len(v)-1], ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			s, err := strconv.Unquote(item)
+			if err != nil {
+				return "", fmt.Errorf("array items must be quoted strings: %s", item)
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	case v == "":
+		return "", errors.New("missing value")
+	}
+	return v, nil
+}
+
+// runConfigCommand handles "config print".
+func runConfigCommand(args []string) {
+	if len(args) == 0 || args[0] != "print" {
+		fmt.Fprintln(os.Stderr, "usage: go-for-web-dev config print [flags]")
+		os.Exit(2)
+	}
+
+	_, settings, err := loadConfig(args[1:])
+	if settings == nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	printConfig(os.Stdout, settings)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "\n"+err.Error())
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTOML(t *testing.T) {
+	input := `
+# top-level keys come first
+env = "production"   # trailing comment
+admins = ["alice", "bob"]
+
+[server]
+port = 9090
+redirect_http = false
+read_timeout = "5s"
+
+[catalog]
+url = "http://example.com/#not-a-comment"
+retries=3
+empty = []
+`
+	want := map[string]string{
+		"env":                  "production",
+		"admins":               "alice,bob",
+		"server.port":          "9090",
+		"server.redirect_http": "false",
+		"server.read_timeout":  "5s",
+		"catalog.url":          "http://example.com/#not-a-comment",
+		"catalog.retries":      "3",
+		"catalog.empty":        "",
+	}
+	got, err := parseTOML(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("parseTOML: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseTOML = %v, want %v", got, want)
+	}
+}
+
+func TestParseTOMLErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"port 8080", "line 1: expected key = value"},
+		{"\n\nport =", "line 3: missing value"},
+		{`admins = ["alice", bob]`, "array items must be quoted strings: bob"},
+		{`admins = ["alice"`, "unterminated array"},
+		{`url = "http://example.com`, "invalid syntax"},
+	}
+	for _, tt := range tests {
+		_, err := parseTOML(strings.NewReader(tt.input))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseTOML(%q) error = %v, want it to mention %q", tt.input, err, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	for _, env := range []string{"CONFIG_FILE", "CATALOG_RETRIES", "BATCH_WORKERS", "TRASH_RETENTION"} {
+		t.Setenv(env, "")
+		os.Unsetenv(env)
+	}
+
+	path := filepath.Join(t.TempDir(), "app.toml")
+	file := "[catalog]\nretries = 1\n\n[batch]\nworkers = 2\n\n[trash]\nretention = \"48h\"\n"
+	if err := os.WriteFile(path, []byte(file), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("BATCH_WORKERS", "3")
+	t.Setenv("TRASH_RETENTION", "72h")
+
+	c, settings, err := loadConfig([]string{"-config", path, "-trash.retention=96h"})
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+
+	if c.CatalogRetries != 1 {
+		t.Errorf("catalog.retries = %d, want 1 from the file", c.CatalogRetries)
+	}
+	if c.BatchWorkers != 3 {
+		t.Errorf("batch.workers = %d, want 3 from the environment", c.BatchWorkers)
+	}
+	if c.TrashRetention != 96*time.Hour {
+		t.Errorf("trash.retention = %v, want 96h from the flag", c.TrashRetention)
+	}
+	if c.CatalogTimeout != 10*time.Second {
+		t.Errorf("catalog.timeout = %v, want the 10s default", c.CatalogTimeout)
+	}
+
+	sources := map[string]string{
+		"catalog.retries": path,
+		"batch.workers":   "$BATCH_WORKERS",
+		"trash.retention": "-trash.retention",
+		"catalog.timeout": "default",
+	}
+	for name, want := range sources {
+		if s := findSetting(settings, name); s == nil || s.source != want {
+			t.Errorf("source of %s = %v, want %q", name, s, want)
+		}
+	}
+}
+
+func TestLoadConfigRejects(t *testing.T) {
+	t.Setenv("CONFIG_FILE", "")
+	os.Unsetenv("CONFIG_FILE")
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-env=staging"}, "env must be development or production"},
+		{[]string{"-env=production"}, "database.url is required in production"},
+		{[]string{"-catalog.retries=64"}, "catalog.retries must be between 0 and 10"},
+		{[]string{"-catalog.breaker_cooldown=0s"}, "catalog.breaker_cooldown must be positive"},
+		{[]string{"-catalog.cache_ttl=0s"}, "catalog.cache_ttl must be positive"},
+		{[]string{"-webhooks.max_attempts=21"}, "webhooks.max_attempts must be between 1 and 20"},
+		{[]string{"-server.port=http"}, `server.port must be a port number, not "http"`},
+		{[]string{"-config", filepath.Join(t.TempDir(), "missing.toml")}, "no such file"},
+	}
+	for _, tt := range tests {
+		if _, _, err := loadConfig(tt.args); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("loadConfig(%q) error = %v, want it to mention %q", tt.args, err, tt.want)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "app.toml")
+	os.WriteFile(path, []byte("[catalog]\nretires = 3\n"), 0644)
+	if _, _, err := loadConfig([]string{"-config=" + path}); err == nil || !strings.Contains(err.Error(), `unknown setting "catalog.retires"`) {
+		t.Errorf("loadConfig with a misspelt key: error = %v", err)
+	}
+}
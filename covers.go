@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	gmux "github.com/larryprice/go-for-web-dev/Godeps/_workspace/src/github.com/gorilla/mux"
+	"github.com/larryprice/go-for-web-dev/Godeps/_workspace/src/gopkg.in/gorp.v1"
+)
+
+const (
+	thumbnailWidth = 80
+	maxCoverSize   = 5 << 20
+	maxCoverPixels = 40 << 20
+)
+
+var (
+	errNoCover       = errors.New("no cover available")
+	errCoverTooLarge = errors.New("cover image has too many pixels")
+	errBookGone      = errors.New("the book is no longer on the shelf")
+)
+
+var coverClient = &http.Client{Timeout: 10 * time.Second}
+
+func coverKey(pk int64) string {
+	return "covers/" + strconv.FormatInt(pk, 10)
+}
+
+func thumbnailKey(pk int64) string {
+	return coverKey(pk) + "-thumb"
+}
+
+// fetchCover downloads a cover for b from Open Library, keyed by ISBN when the
+// book has one and by OCLC number otherwise, and stores it.
+func fetchCover(b *Book, oclc string) error {
+	var u string
+	if b.ISBN != "" {
+		u = "http://covers.openlibrary.org/b/isbn/" + url.QueryEscape(b.ISBN) + "-L.jpg?default=false"
+	} else if oclc != "" {
+		u = "http://covers.openlibrary.org/b/oclc/" + url.QueryEscape(oclc) + "-L.jpg?default=false"
+	} else {
+		return errNoCover
+	}
+
+	resp, err := coverClient.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errNoCover
+	} else if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("cover provider returned %s", resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxCoverSize))
+	if err != nil {
+		return err
+	}
+	return saveCover(b, data)
+}
+
+// fetchCoverInBackground fetches the cover for a copy of b without holding up
+// the request that added it. The listing shows the cover on its next load.
+func fetchCoverInBackground(b Book, oclc string) {
+	go fetchCover(&b, oclc)
+}
+
+// decodeCover decodes an uploaded or fetched image. The header is checked
+// first so that a small file claiming huge dimensions is rejected before the
+// decoder allocates the pixels.
+func decodeCover(data []byte) (image.Image, string, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width > maxCoverPixels/config.Height {
+		return nil, "", errCoverTooLarge
+	}
+	return image.Decode(bytes.NewReader(data))
+}
+
+// saveCover validates the image, stores it with a thumbnail and records its
+// version on the book. Covers are often fetched in the background, so nothing
+// is stored once the book has been trashed or purged.
+func saveCover(b *Book, data []byte) error {
+	img, format, err := decodeCover(data)
+	if err != nil {
+		return err
+	}
+
+	var thumb bytes.Buffer
+	if err = jpeg.Encode(&thumb, thumbnail(img, thumbnailWidth), &jpeg.Options{Quality: 85}); err != nil {
+		return err
+	}
+
+	onShelf, err := dbmap.SelectInt("select count(*) from books where pk="+dbmap.Dialect.BindVar(0)+" and deleted_at=0", b.PK)
+	if err != nil {
+		return err
+	} else if onShelf == 0 {
+		return errBookGone
+	}
+
+	if err = covers.Put(coverKey(b.PK), data, "image/"+format); err != nil {
+		return err
+	}
+	if err = covers.Put(thumbnailKey(b.PK), thumb.Bytes(), "image/jpeg"); err != nil {
+		return err
+	}
+
+	return setCover(b, sha256Hex(data)[:16])
+}
+
+// setCover records a new cover version on the book and reloads b. Only the
+// cover column is written: b may be a copy taken before the fetch started,
+// and writing the whole row back would undo a trash or an edit made since.
+// The hooks' audit entry and webhooks are written in the same transaction.
+func setCover(b *Book, version string) error {
+	return inTransaction(func(tx *gorp.Transaction) error {
+		res, err := tx.Exec("update books set cover="+dbmap.Dialect.BindVar(0)+
+			" where pk="+dbmap.Dialect.BindVar(1)+" and deleted_at=0", version, b.PK)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return errBookGone
+		}
+
+		if err := tx.SelectOne(b, "select * from books where pk="+dbmap.Dialect.BindVar(0), b.PK); err != nil {
+			return err
+		}
+		if err := recordAudit(tx, b.actor(), "book.update", b.PK, "cover"); err != nil {
+			return err
+		}
+		return queueWebhooks(tx, "book.update", b)
+	})
+}
+
+func deleteCover(b *Book) {
+	covers.Delete(coverKey(b.PK))
+	covers.Delete(thumbnailKey(b.PK))
+}
+
+// thumbnail scales img down to width pixels wide using an area average,
+// keeping the aspect ratio. Images already narrower are returned unchanged.
+func thumbnail(img image.Image, width int) image.Image {
+	src := img.Bounds()
+	if src.Dx() <= width {
+		return img
+	}
+	height := src.Dy() * width / src.Dx()
+	if height < 1 {
+		height = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := src.Min.Y + y*src.Dy()/height
+		y1 := src.Min.Y + (y+1)*src.Dy()/height
+		for x := 0; x < width; x++ {
+			x0 := src.Min.X + x*src.Dx()/width
+			x1 := src.Min.X + (x+1)*src.Dx()/width
+
+			var r, g, bl, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := img.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+pr, g+pg, bl+pb, a+pa, n+1
+				}
+			}
+
+			i := dst.PixOffset(x, y)
+			dst.Pix[i+0] = uint8(r / n >> 8)
+			dst.Pix[i+1] = uint8(g / n >> 8)
+			dst.Pix[i+2] = uint8(bl / n >> 8)
+			dst.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+	return dst
+}
+
+// getUserBook loads one of the user's books that is on the shelf. Books in
+// the trash are only reachable through getTrashedBook.
+func getUserBook(b *Book, pk int64, username string) error {
+	return selectUserBook(b, pk, username, " and deleted_at=0")
+}
+
+func getTrashedBook(b *Book, pk int64, username string) error {
+	return selectUserBook(b, pk, username, " and deleted_at<>0")
+}
+
+func selectUserBook(b *Book, pk int64, username, cond string) error {
+	q := "select * from books where pk=" + dbmap.Dialect.BindVar(0) + " and \"user\"=" + dbmap.Dialect.BindVar(1) + cond
+	return dbmap.SelectOne(b, q, pk, username)
+}
+
+func serveCover(w http.ResponseWriter, r *http.Request, username string, key func(int64) string) {
+	pk, _ := strconv.ParseInt(gmux.Vars(r)["pk"], 10, 64)
+	var b Book
+	if err := getUserBook(&b, pk, username); err != nil || b.Cover == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	etag := `"` + b.Cover + `"`
+	if r.FormValue("v") == b.Cover {
+		w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "private, max-age=0, must-revalidate")
+	}
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	data, contentType, err := covers.Get(key(b.PK))
+	if err == errBlobNotFound {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Write(data)
+}
+
+func registerCoverRoutes(mux *router) {
+	mux.HandleFunc("/books/{pk}/cover", func(w http.ResponseWriter, r *http.Request) {
+		serveCover(w, r, getStringFromSession(r, "User"), coverKey)
+	}).Methods("GET")
+
+	mux.HandleFunc("/books/{pk}/cover/thumb", func(w http.ResponseWriter, r *http.Request) {
+		serveCover(w, r, getStringFromSession(r, "User"), thumbnailKey)
+	}).Methods("GET")
+
+	mux.HandleFunc("/books/{pk}/cover", func(w http.ResponseWriter, r *http.Request) {
+		pk, _ := strconv.ParseInt(gmux.Vars(r)["pk"], 10, 64)
+		var b Book
+		if err := getUserBook(&b, pk, getStringFromSession(r, "User")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxCoverSize)
+		file, _, err := r.FormFile("cover")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+
+		data, err := ioutil.ReadAll(file)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err = saveCover(&b, data); err == errBookGone {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(b); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}).Methods("POST")
+}
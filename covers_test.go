@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"testing"
+)
+
+// pngClaiming returns a 1x1 PNG whose header claims the given dimensions.
+func pngClaiming(t *testing.T, width, height uint32) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	// The IHDR chunk follows the 8 byte signature: length, type, then width
+	// and height, with its CRC over type and data after the 13 data bytes.
+	ihdr := data[8+4 : 8+4+4+13]
+	binary.BigEndian.PutUint32(ihdr[4:], width)
+	binary.BigEndian.PutUint32(ihdr[8:], height)
+	binary.BigEndian.PutUint32(data[8+4+4+13:], crc32.ChecksumIEEE(ihdr))
+	return data
+}
+
+func TestDecodeCover(t *testing.T) {
+	img, format, err := decodeCover(pngClaiming(t, 1, 1))
+	if err != nil || format != "png" || img.Bounds().Dx() != 1 {
+		t.Errorf("decodeCover of a 1x1 PNG = %v, %q, %v", img, format, err)
+	}
+
+	if _, _, err := decodeCover(pngClaiming(t, 100000, 100000)); err != errCoverTooLarge {
+		t.Errorf("decodeCover of a 100000x100000 PNG header: err = %v, want errCoverTooLarge", err)
+	}
+	if _, _, err := decodeCover([]byte("not an image")); err == nil {
+		t.Error("decodeCover of garbage succeeded")
+	}
+}
+
+func TestThumbnail(t *testing.T) {
+	tests := []struct {
+		width, height int
+		wantW, wantH  int
+	}{
+		{400, 600, thumbnailWidth, 120},
+		{thumbnailWidth, 100, thumbnailWidth, 100},
+		{40, 60, 40, 60},
+		{1000, 5, thumbnailWidth, 1},
+	}
+	for _, tt := range tests {
+		got := thumbnail(image.NewRGBA(image.Rect(0, 0, tt.width, tt.height)), thumbnailWidth).Bounds()
+		if got.Dx() != tt.wantW || got.Dy() != tt.wantH {
+			t.Errorf("thumbnail of %dx%d is %dx%d, want %dx%d", tt.width, tt.height, got.Dx(), got.Dy(), tt.wantW, tt.wantH)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// The Dewey Decimal Classification is a hierarchy of 10 main classes, 100
+// divisions and 1000 sections, identified by the first one, two or three
+// digits of a class number. Nodes are referred to by that digit prefix, so
+// "8" is Literature (800), "81" American literature (810) and "813" American
+// fiction.
+
+var deweyClasses = [10]string{
+	"Computer science, information & general works",
+	"Philosophy & psychology",
+	"Religion",
+	"Social sciences",
+	"Language",
+	"Science",
+	"Technology",
+	"Arts & recreation",
+	"Literature",
+	"History & geography",
+}
+
+var deweyDivisions = [100]string{
+	"Computer science, knowledge & systems", "Bibliographies", "Library & information sciences",
+	"Encyclopedias & books of facts", "[Unassigned]", "Magazines, journals & serials",
+	"Associations, organizations & museums", "News media, journalism & publishing", "Quotations",
+	"Manuscripts & rare books",
+
+	"Philosophy", "Metaphysics", "Epistemology", "Parapsychology & occultism",
+	"Philosophical schools of thought", "Psychology", "Philosophical logic", "Ethics",
+	"Ancient, medieval & eastern philosophy", "Modern western philosophy",
+
+	"Religion", "Philosophy & theory of religion", "The Bible", "Christianity",
+	"Christian practice & observance", "Christian pastoral practice & religious orders",
+	"Christian organization, social work & worship", "History of Christianity",
+	"Christian denominations", "Other religions",
+
+	"Social sciences, sociology & anthropology", "Statistics", "Political science", "Economics", "Law",
+	"Public administration & military science", "Social problems & social services", "Education",
+	"Commerce, communications & transportation", "Customs, etiquette & folklore",
+
+	"Language", "Linguistics", "English & Old English languages", "German & related languages",
+	"French & related languages", "Italian, Romanian & related languages",
+	"Spanish, Portuguese, Galician", "Latin & Italic languages", "Classical & modern Greek languages",
+	"Other languages",
+
+	"Science", "Mathematics", "Astronomy", "Physics", "Chemistry", "Earth sciences & geology",
+	"Fossils & prehistoric life", "Biology", "Plants (Botany)", "Animals (Zoology)",
+
+	"Technology", "Medicine & health", "Engineering", "Agriculture", "Home & family management",
+	"Management & public relations", "Chemical engineering", "Manufacturing",
+	"Manufacture for specific uses", "Construction of buildings",
+
+	"Arts", "Area planning & landscape architecture", "Architecture", "Sculpture, ceramics & metalwork",
+	"Graphic arts & decorative arts", "Painting", "Printmaking & prints",
+	"Photography, computer art, film, video", "Music", "Sports, games & entertainment",
+
+	"Literature, rhetoric & criticism", "American literature in English", "English & Old English literatures",
+	"German & related literatures", "French & related literatures",
+	"Italian, Romanian & related literatures", "Spanish, Portuguese, Galician literatures",
+	"Latin & Italic literatures", "Classical & modern Greek literatures", "Other literatures",
+
+	"History", "Geography & travel", "Biography & genealogy", "History of ancient world (to ca. 499)",
+	"History of Europe", "History of Asia", "History of Africa", "History of North America",
+	"History of South America", "History of other areas",
+}
+
+// The literatures 810-880 share the same sections: 813 is American fiction,
+// 823 English fiction, 843 French fiction and so on.
+var deweyLiteratures = map[byte]string{
+	'1': "American", '2': "English", '3': "German", '4': "French",
+	'5': "Italian", '6': "Spanish & Portuguese", '7': "Latin", '8': "Greek",
+}
+
+var deweyLiteratureForms = map[byte]string{
+	'0': "literature", '1': "poetry", '2': "drama", '3': "fiction", '4': "essays",
+	'5': "speeches", '6': "letters", '7': "humor & satire", '8': "miscellaneous writings",
+}
+
+// deweyName returns the caption of the node with the given digit prefix.
+// Sections without a caption of their own are named after their division.
+func deweyName(node string) string {
+	switch len(node) {
+	case 1:
+		return deweyClasses[node[0]-'0']
+	case 2:
+		return deweyDivisions[(node[0]-'0')*10+node[1]-'0']
+	case 3:
+		if lit, ok := deweyLiteratures[node[1]]; ok && node[0] == '8' {
+			if form, ok := deweyLiteratureForms[node[2]]; ok {
+				return lit + " " + form
+			}
+		}
+		return deweyName(node[:2])
+	}
+	return "Dewey Decimal Classification"
+}
+
+// deweyNumber returns the class number a classification starts with, e.g.
+// "813.54" for "813/.54". It reports false for values that are not Dewey
+// numbers, like "B", "FIC" or "".
+func deweyNumber(classification string) (string, bool) {
+	c := deweyMarks.Replace(strings.TrimSpace(classification))
+	n := deweyNumberPattern.FindString(c)
+	return n, n != ""
+}
+
+var deweyNumberPattern = regexp.MustCompile(`^\d{3}(\.\d+)?`)
+
+// deweyMarks removes the segmentation marks catalogs put in Dewey numbers,
+// as in "813/.54" and "823'.912".
+var deweyMarks = strings.NewReplacer("/", "", "'", "")
+
+// deweyDigits drops the decimal point so that nodes can be matched by prefix.
+func deweyDigits(number string) string {
+	return strings.Replace(number, ".", "", 1)
+}
+
+// isFiction reports whether a classification is fiction: the x3 section of
+// one of the literatures 810-880, 891.x3 for other literatures, 808.83 for
+// collections, or one of the FIC labels libraries use instead of a number.
+func isFiction(classification string) bool {
+	switch strings.ToUpper(strings.Trim(classification, " []")) {
+	case "FIC", "F":
+		return true
+	}
+
+	n, ok := deweyNumber(classification)
+	if !ok {
+		return false
+	}
+	d := deweyDigits(n)
+	switch {
+	case d[0] == '8' && d[1] >= '1' && d[1] <= '8' && d[2] == '3':
+		return true
+	case strings.HasPrefix(d, "891") && len(d) >= 5 && d[4] == '3':
+		return true
+	}
+	return strings.HasPrefix(d, "80883")
+}
+
+var errInvalidFilter = errors.New("invalid filter: use all, fiction, nonfiction, ddc:<node> or ddc:<from>-<to>")
+
+// parseClassFilter turns a filter parameter into a predicate on
+// classifications. Besides all, fiction and nonfiction it accepts a Dewey
+// node ("ddc:8", "ddc:81", "ddc:813.5") or an inclusive range
+// ("ddc:800-899", "ddc:810-819.9"). A nil predicate matches every book.
+func parseClassFilter(filter string) (func(string) bool, error) {
+	switch filter {
+	case "", "all":
+		return nil, nil
+	case "fiction":
+		return isFiction, nil
+	case "nonfiction":
+		return func(c string) bool { return strings.TrimSpace(c) != "" && !isFiction(c) }, nil
+	}
+
+	if !strings.HasPrefix(filter, "ddc:") {
+		return nil, errInvalidFilter
+	}
+	spec := filter[len("ddc:"):]
+
+	if from, to, ok := strings.Cut(spec, "-"); ok {
+		if from == "" || deweyNumberPattern.FindString(from) != from ||
+			to == "" || deweyNumberPattern.FindString(to) != to || from > to {
+			return nil, errInvalidFilter
+		}
+		return func(c string) bool {
+			n, ok := deweyNumber(c)
+			// Numbers subdividing the upper bound are part of the range,
+			// so 899.9 is in 800-899.
+			return ok && n >= from && (n <= to || strings.HasPrefix(n, to))
+		}, nil
+	}
+
+	if !deweyNodePattern.MatchString(spec) {
+		return nil, errInvalidFilter
+	}
+	prefix := deweyDigits(spec)
+	return func(c string) bool {
+		n, ok := deweyNumber(c)
+		return ok && strings.HasPrefix(deweyDigits(n), prefix)
+	}, nil
+}
+
+var deweyNodePattern = regexp.MustCompile(`^(\d{1,2}|\d{3}(\.\d+)?)$`)
+
+// filterBooks keeps the books whose classification matches.
+func filterBooks(books []Book, match func(string) bool) []Book {
+	if match == nil {
+		return books
+	}
+	kept := make([]Book, 0, len(books))
+	for _, b := range books {
+		if match(b.Classification) {
+			kept = append(kept, b)
+		}
+	}
+	return kept
+}
+
+type DeweyNode struct {
+	Node   string
+	Number string
+	Name   string
+	Filter string
+	Count  int
+}
+
+// DeweyBrowse is one level of the hierarchy: the path from the top down to
+// the requested node and the node's children with the number of books in
+// each.
+type DeweyBrowse struct {
+	Path         []DeweyNode
+	Children     []DeweyNode
+	Unclassified int
+}
+
+func newDeweyNode(node string, counts map[string]int) DeweyNode {
+	return DeweyNode{
+		Node:   node,
+		Number: (node + "00")[:3],
+		Name:   deweyName(node),
+		Filter: "ddc:" + node,
+		Count:  counts[node],
+	}
+}
+
+func browseDewey(books []Book, node string) DeweyBrowse {
+	counts := map[string]int{}
+	var browse DeweyBrowse
+	for _, b := range books {
+		n, ok := deweyNumber(b.Classification)
+		if !ok {
+			browse.Unclassified++
+			continue
+		}
+		d := deweyDigits(n)
+		counts[d[:1]]++
+		counts[d[:2]]++
+		counts[d[:3]]++
+	}
+
+	for i := 1; i <= len(node); i++ {
+		browse.Path = append(browse.Path, newDeweyNode(node[:i], counts))
+	}
+	if len(node) < 3 {
+		for digit := '0'; digit <= '9'; digit++ {
+			browse.Children = append(browse.Children, newDeweyNode(node+string(digit), counts))
+		}
+	}
+	return browse
+}
+
+var deweyBrowsePattern = regexp.MustCompile(`^\d{1,3}$`)
+
+func registerDeweyRoutes(mux *router) {
+	mux.HandleFunc("/books/dewey", func(w http.ResponseWriter, r *http.Request) {
+		node := r.FormValue("node")
+		if node != "" && !deweyBrowsePattern.MatchString(node) {
+			http.Error(w, "node must be one to three digits", http.StatusBadRequest)
+			return
+		}
+
+		var b []Book
+		if !getBookCollection(&b, listAllPreferences(getStringFromSession(r, "User")), w) {
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(browseDewey(b, node)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}).Methods("GET")
+}
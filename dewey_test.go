@@ -0,0 +1,116 @@
+package main
+
+import "testing"
+
+func TestDeweyNumber(t *testing.T) {
+	tests := []struct {
+		classification string
+		want           string
+		ok             bool
+	}{
+		{"813.54", "813.54", true},
+		{"813/.54", "813.54", true},
+		{" 823'.912 ", "823.912", true},
+		{"500", "500", true},
+		{"641.5973 B", "641.5973", true},
+		{"FIC", "", false},
+		{"B", "", false},
+		{"", "", false},
+		{"81", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := deweyNumber(tt.classification)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("deweyNumber(%q) = %q, %v, want %q, %v", tt.classification, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestDeweyName(t *testing.T) {
+	tests := []struct {
+		node string
+		want string
+	}{
+		{"", "Dewey Decimal Classification"},
+		{"8", "Literature"},
+		{"81", "American literature in English"},
+		{"813", "American fiction"},
+		{"841", "French poetry"},
+		{"890", "Other literatures"},
+		{"512", "Mathematics"},
+	}
+	for _, tt := range tests {
+		if got := deweyName(tt.node); got != tt.want {
+			t.Errorf("deweyName(%q) = %q, want %q", tt.node, got, tt.want)
+		}
+	}
+}
+
+func TestIsFiction(t *testing.T) {
+	tests := []struct {
+		classification string
+		want           bool
+	}{
+		{"813.54", true},
+		{"823/.912", true},
+		{"891.733", true},
+		{"808.83", true},
+		{"FIC", true},
+		{"[Fic]", true},
+		{"811.54", false},
+		{"803", false},
+		{"891.71", false},
+		{"973", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := isFiction(tt.classification); got != tt.want {
+			t.Errorf("isFiction(%q) = %v, want %v", tt.classification, got, tt.want)
+		}
+	}
+}
+
+func TestParseClassFilter(t *testing.T) {
+	tests := []struct {
+		filter  string
+		matches []string
+		misses  []string
+	}{
+		{"all", []string{"813.54", "", "FIC"}, nil},
+		{"fiction", []string{"813.54", "FIC"}, []string{"973", ""}},
+		{"nonfiction", []string{"973", "B"}, []string{"813.54", ""}},
+		{"ddc:8", []string{"800", "813.54", "899.9"}, []string{"700", "FIC", ""}},
+		{"ddc:81", []string{"810", "813.54"}, []string{"820", "800"}},
+		{"ddc:813", []string{"813", "813/.54"}, []string{"814"}},
+		{"ddc:813.5", []string{"813.54", "813.5"}, []string{"813.4", "813"}},
+		{"ddc:800-899", []string{"800", "850.1", "899", "899.95"}, []string{"799.9", "900", "FIC"}},
+		{"ddc:810-819.9", []string{"810", "819.9", "819.95"}, []string{"809", "820"}},
+	}
+	for _, tt := range tests {
+		match, err := parseClassFilter(tt.filter)
+		if err != nil {
+			t.Errorf("parseClassFilter(%q): %v", tt.filter, err)
+			continue
+		}
+		for _, c := range tt.matches {
+			if match != nil && !match(c) {
+				t.Errorf("filter %q does not match %q", tt.filter, c)
+			}
+		}
+		for _, c := range tt.misses {
+			if match == nil || match(c) {
+				t.Errorf("filter %q matches %q", tt.filter, c)
+			}
+		}
+	}
+}
+
+func TestParseClassFilterRejects(t *testing.T) {
+	for _, filter := range []string{
+		"poetry", "ddc:", "ddc:8a", "ddc:8131", "ddc:81.5", "ddc:899-800", "ddc:800-", "ddc:-899", "ddc:8-9",
+	} {
+		if _, err := parseClassFilter(filter); err != errInvalidFilter {
+			t.Errorf("parseClassFilter(%q) error = %v, want errInvalidFilter", filter, err)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/larryprice/go-for-web-dev/Godeps/_workspace/src/gopkg.in/gorp.v1"
+)
+
+// duplicateThreshold is the minimum similarity of two books' normalised
+// title and author for them to be reported as possible duplicates.
+const duplicateThreshold = 0.85
+
+type DuplicatePair struct {
+	Books [2]Book
+	Score float64
+}
+
+// findExistingBook returns the user's copy of the work with the given OCLC
+// work ID, or nil when they do not own it yet.
+func findExistingBook(exec gorp.SqlExecutor, id, username string) (*Book, error) {
+	var books []Book
+	q := "select * from books where id=" + dbmap.Dialect.BindVar(0) + " and \"user\"=" + dbmap.Dialect.BindVar(1)
+	if _, err := exec.Select(&books, q, id, username); err != nil {
+		return nil, err
+	}
+	if len(books) == 0 {
+		return nil, nil
+	}
+	return &books[0], nil
+}
+
+// rejectDuplicate writes a 409 with the existing record when the user already
+// owns the work. It returns true when the request has been answered.
+func rejectDuplicate(id, username string, w http.ResponseWriter) bool {
+	existing, err := findExistingBook(dbmap, id, username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return true
+	}
+	if existing == nil {
+		return false
+	}
+
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(existing)
+	return true
+}
+
+// insertBook adds b unless the user already owns the work, in which case the
+// existing record is returned with a 409.
+func insertBook(b *Book, w http.ResponseWriter) bool {
+	if rejectDuplicate(b.ID, b.User, w) {
+		return false
+	}
+	if err := createBook(b); err != nil {
+		// The failed insert was rolled back, so an existing record can only
+		// come from a concurrent insert of the same work.
+		if !rejectDuplicate(b.ID, b.User, w) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return false
+	}
+	b.CallNumber = callNumber(b, userScheme(b.User))
+	return true
+}
+
+// findPossibleDuplicates compares every pair of books by the edit distance of
+// their normalised title and author.
+func findPossibleDuplicates(books []Book) []DuplicatePair {
+	keys := make([][]rune, len(books))
+	byLength := make([]int, len(books))
+	for i, b := range books {
+		keys[i] = []rune(normalizeForMatch(b.Title) + " " + normalizeForMatch(b.Author))
+		byLength[i] = i
+	}
+	sort.SliceStable(byLength, func(x, y int) bool { return len(keys[byLength[x]]) < len(keys[byLength[y]]) })
+
+	// The edit distance is at least the difference in length, so a key can
+	// only reach the threshold against keys not much longer than itself.
+	type match struct {
+		i, j  int
+		score float64
+	}
+	var matches []match
+	for x, i := range byLength {
+		for _, j := range byLength[x+1:] {
+			if float64(len(keys[i])) < duplicateThreshold*float64(len(keys[j])) {
+				break
+			}
+			if score := similarity(keys[i], keys[j]); score >= duplicateThreshold {
+				matches = append(matches, match{min(i, j), max(i, j), score})
+			}
+		}
+	}
+
+	sort.Slice(matches, func(x, y int) bool {
+		if matches[x].i != matches[y].i {
+			return matches[x].i < matches[y].i
+		}
+		return matches[x].j < matches[y].j
+	})
+	pairs := []DuplicatePair{}
+	for _, m := range matches {
+		pairs = append(pairs, DuplicatePair{[2]Book{books[m.i], books[m.j]}, m.score})
+	}
+	return pairs
+}
+
+// normalizeForMatch lowercases s, drops punctuation and leading articles and
+// collapses whitespace.
+func normalizeForMatch(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return ' '
+	}, s)
+	words := strings.Fields(s)
+	if len(words) > 1 && (words[0] == "the" || words[0] == "a" || words[0] == "an") {
+		words = words[1:]
+	}
+	return strings.Join(words, " ")
+}
+
+func similarity(a, b []rune) float64 {
+	longest := len(a)
+	if len(b) > longest {
+		longest = len(b)
+	}
+	if longest == 0 {
+		return 1
+	}
+	limit := int(math.Ceil(float64(longest) * (1 - duplicateThreshold)))
+	return 1 - float64(levenshtein(a, b, limit))/float64(longest)
+}
+
+// levenshtein returns the edit distance between a and b. Once every
+// alignment costs more than limit it stops early and returns limit+1.
+func levenshtein(a, b []rune, limit int) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		best := i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			best = min(best, cur[j])
+		}
+		if best > limit {
+			return limit + 1
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func registerDuplicateRoutes(mux *router) {
+	mux.HandleFunc("/books/duplicates", func(w http.ResponseWriter, r *http.Request) {
+		var b []Book
+		if !getBookCollection(&b, listAllPreferences(getStringFromSession(r, "User")), w) {
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(findPossibleDuplicates(b)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}).Methods("GET")
+}
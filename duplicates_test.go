@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLevenshtein(t *testing.T) {
+	tests := []struct {
+		a, b  string
+		limit int
+		want  int
+	}{
+		{"", "", 5, 0},
+		{"kitten", "sitting", 5, 3},
+		{"kitten", "sitting", 3, 3},
+		{"kitten", "sitting", 2, 3},
+		{"kitten", "sitting", 0, 1},
+		{"dune", "dune", 0, 0},
+		{"abc", "", 10, 3},
+	}
+	for _, tt := range tests {
+		if got := levenshtein([]rune(tt.a), []rune(tt.b), tt.limit); got != tt.want {
+			t.Errorf("levenshtein(%q, %q, %d) = %d, want %d", tt.a, tt.b, tt.limit, got, tt.want)
+		}
+	}
+}
+
+func TestFindPossibleDuplicates(t *testing.T) {
+	books := []Book{
+		{PK: 1, Title: "The Left Hand of Darkness", Author: "Ursula K. Le Guin"},
+		{PK: 2, Title: "Dune", Author: "Frank Herbert"},
+		{PK: 3, Title: "Left Hand of Darkness", Author: "Ursula K Le Guin"},
+		{PK: 4, Title: "Dune Messiah", Author: "Frank Herbert"},
+		{PK: 5, Title: "Dune.", Author: "Herbert, Frank"},
+		{PK: 6, Title: "Dune", Author: "Frank Herbert"},
+	}
+	var got []string
+	for _, p := range findPossibleDuplicates(books) {
+		got = append(got, fmt.Sprintf("%d-%d", p.Books[0].PK, p.Books[1].PK))
+	}
+	want := []string{"1-3", "2-6"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("findPossibleDuplicates = %v, want %v", got, want)
+	}
+}
+
+func TestFindPossibleDuplicatesMatchesFullComparison(t *testing.T) {
+	titles := []string{"Dune", "Dunes", "Dune Messiah", "The Hobbit", "Hobbit", "The Hobbitt",
+		"Emma", "Emmaa", "A", "", "War and Peace", "War & Peace", "War and Peas"}
+	var books []Book
+	for i, title := range titles {
+		books = append(books, Book{PK: int64(i), Title: title, Author: "X"})
+	}
+
+	var want []string
+	for i := range books {
+		for j := i + 1; j < len(books); j++ {
+			a := []rune(normalizeForMatch(books[i].Title) + " X")
+			b := []rune(normalizeForMatch(books[j].Title) + " X")
+			longest := max(len(a), len(b))
+			if 1-float64(levenshtein(a, b, longest))/float64(longest) >= duplicateThreshold {
+				want = append(want, fmt.Sprintf("%d-%d", i, j))
+			}
+		}
+	}
+	var got []string
+	for _, p := range findPossibleDuplicates(books) {
+		got = append(got, fmt.Sprintf("%d-%d", p.Books[0].PK, p.Books[1].PK))
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("findPossibleDuplicates = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"time"
+
+	gmux "github.com/larryprice/go-for-web-dev/Godeps/_workspace/src/github.com/gorilla/mux"
+)
+
+// Feeds of recently added books live under /feeds/{token}/, where token is
+// the user's secret feed token. Feed readers cannot log in, so these paths
+// skip the session check and the token alone identifies the user. Replacing
+// the token revokes every URL built from the old one.
+
+const feedLength = 50
+
+func newFeedToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// feedUser returns the user owning token, or nil if no user does.
+func feedUser(token string) *User {
+	if token == "" {
+		return nil
+	}
+	var user User
+	if err := dbmap.SelectOne(&user, "select * from users where feed_token="+dbmap.Dialect.BindVar(0), token); err != nil {
+		return nil
+	}
+	return &user
+}
+
+// ensureFeedToken gives users registered before feeds existed a token.
+func ensureFeedToken(username string) (string, error) {
+	obj, err := dbmap.Get(User{}, username)
+	if err != nil || obj == nil {
+		return "", err
+	}
+	user := obj.(*User)
+	if user.FeedToken == "" {
+		user.FeedToken = newFeedToken()
+		_, err = dbmap.Update(user)
+	}
+	return user.FeedToken, err
+}
+
+// baseURL is the scheme and host the request was made to, for building the
+// absolute links feeds need.
+func baseURL(r *http.Request) string {
+	if r.TLS != nil {
+		return "https://" + r.Host
+	}
+	return "http://" + r.Host
+}
+
+// feedItem is a recently added book. Books keep no creation date, so it is
+// taken from the audit log.
+type feedItem struct {
+	PK             int64  `db:"pk"`
+	Title          string `db:"title"`
+	Author         string `db:"author"`
+	User           string `db:"user"`
+	Classification string `db:"classification"`
+	Year           string `db:"year"`
+	At             int64  `db:"at"`
+}
+
+func (i feedItem) summary() string {
+	s := "by " + i.Author
+	if i.Year != "" {
+		s += " (" + i.Year + ")"
+	}
+	if i.Classification != "" {
+		s += ", classified " + i.Classification
+	}
+	return s
+}
+
+func (i feedItem) added() time.Time {
+	return time.Unix(i.At, 0).UTC()
+}
+
+// recentlyAdded returns the newest books of username, or of every user when
+// username is empty.
+func recentlyAdded(username string) ([]feedItem, error) {
+	q := `select b.pk, b.title, b.author, b."user", b.classification, b.year, coalesce(a.at, 0) as at
+		from books b left join audit_log a on a.book_pk=b.pk and a.action='book.create'
+		where b.deleted_at=0`
+	var args []interface{}
+	if username != "" {
+		q += ` and b."user"=` + dbmap.Dialect.BindVar(0)
+		args = append(args, username)
+	}
+	q += " order by b.pk desc limit " + strconv.Itoa(feedLength)
+
+	items := []feedItem{}
+	_, err := dbmap.Select(&items, q, args...)
+	return items, err
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	Title   string   `xml:"title"`
+	ID      string   `xml:"id"`
+	Updated string   `xml:"updated"`
+	Author  string   `xml:"author>name"`
+	Summary string   `xml:"summary"`
+	Link    atomLink `xml:"link"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	Description string  `xml:"description"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	ID          string `xml:",chardata"`
+}
+
+func buildAtomFeed(title, self, base string, items []feedItem) atomFeed {
+	feed := atomFeed{
+		Title:   title,
+		ID:      self,
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Links:   []atomLink{{Rel: "self", Type: "application/atom+xml", Href: self}, {Href: base + "/"}},
+	}
+	if len(items) > 0 {
+		feed.Updated = items[0].added().Format(time.RFC3339)
+	}
+	for _, i := range items {
+		feed.Entries = append(feed.Entries, atomEntry{
+			Title:   i.Title,
+			ID:      base + "/books/" + strconv.FormatInt(i.PK, 10),
+			Updated: i.added().Format(time.RFC3339),
+			Author:  i.User,
+			Summary: i.summary(),
+			Link:    atomLink{Href: base + "/"},
+		})
+	}
+	return feed
+}
+
+func buildRSSFeed(title, base string, items []feedItem) rssFeed {
+	feed := rssFeed{Version: "2.0", Channel: rssChannel{
+		Title:       title,
+		Link:        base + "/",
+		Description: "Books recently added to the library",
+	}}
+	if len(items) > 0 {
+		feed.Channel.LastBuildDate = items[0].added().Format(time.RFC1123Z)
+	}
+	for _, i := range items {
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title:       i.Title,
+			Link:        base + "/",
+			Description: i.summary() + ", added by " + i.User,
+			GUID:        rssGUID{ID: base + "/books/" + strconv.FormatInt(i.PK, 10)},
+			PubDate:     i.added().Format(time.RFC1123Z),
+		})
+	}
+	return feed
+}
+
+func registerFeedRoutes(mux *router) {
+	mux.HandleFunc("/feeds/{token}/{scope:books|library}.{format:atom|rss}", func(w http.ResponseWriter, r *http.Request) {
+		vars := gmux.Vars(r)
+		user := feedUser(vars["token"])
+		if user == nil {
+			http.NotFound(w, r)
+			return
+		}
+		requestLogFrom(r.Context()).User = user.Username
+
+		title, owner := "Books added by "+user.Username, user.Username
+		if vars["scope"] == "library" {
+			title, owner = "Books added to the library", ""
+		}
+		items, err := recentlyAdded(owner)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		base := baseURL(r)
+		var feed interface{}
+		if vars["format"] == "atom" {
+			w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+			feed = buildAtomFeed(title, base+r.URL.Path, base, items)
+		} else {
+			w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+			feed = buildRSSFeed(title, base, items)
+		}
+		w.Write([]byte(xml.Header))
+		enc := xml.NewEncoder(w)
+		enc.Indent("", "  ")
+		if err := enc.Encode(feed); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}).Methods("GET")
+
+	mux.HandleFunc("/settings/feed-token", func(w http.ResponseWriter, r *http.Request) {
+		obj, err := dbmap.Get(User{}, getStringFromSession(r, "User"))
+		if err != nil || obj == nil {
+			http.Error(w, "unknown user", http.StatusInternalServerError)
+			return
+		}
+		user := obj.(*User)
+		user.FeedToken = newFeedToken()
+		if _, err := dbmap.Update(user); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(baseURL(r) + "/feeds/" + user.FeedToken))
+	}).Methods("POST")
+}
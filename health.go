@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const dbMonitorInterval = 15 * time.Second
+
+// dbMonitor pings the database in the background so readiness checks do not
+// have to, and so outages show up in the logs as they start and end.
+var dbMonitor = struct {
+	sync.Mutex
+	err     error
+	checked time.Time
+}{}
+
+func pingDb() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	return db.PingContext(ctx)
+}
+
+func monitorDb() {
+	for {
+		err := pingDb()
+
+		dbMonitor.Lock()
+		if err != nil && dbMonitor.err == nil {
+			logger.Error("database unreachable", "error", err.Error())
+		} else if err == nil && dbMonitor.err != nil {
+			logger.Info("database reachable again")
+		}
+		dbMonitor.err, dbMonitor.checked = err, time.Now()
+		dbMonitor.Unlock()
+
+		time.Sleep(dbMonitorInterval)
+	}
+}
+
+// dbStatus returns the last result of the background monitor, pinging now if
+// it has not run recently.
+func dbStatus() error {
+	dbMonitor.Lock()
+	err, checked := dbMonitor.err, dbMonitor.checked
+	dbMonitor.Unlock()
+
+	if time.Since(checked) > 2*dbMonitorInterval {
+		return pingDb()
+	}
+	return err
+}
+
+// pendingMigrations lists the column and index migrations that have not been
+// applied.
+func pendingMigrations() []string {
+	var pending []string
+	for _, m := range columnMigrations {
+		if !columnExists(m) {
+			pending = append(pending, m.Table+"."+m.Column)
+		}
+	}
+	for _, m := range indexMigrations {
+		if !indexExists(m) {
+			pending = append(pending, m.Name)
+		}
+	}
+	return pending
+}
+
+type ReadinessReport struct {
+	Ready  bool
+	Checks map[string]string
+}
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte("ok\n"))
+}
+
+// readyzHandler reports whether the server can take traffic. The catalog is
+// only checked, and only counts, when the request asks for ?catalog=true.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	report := ReadinessReport{Ready: true, Checks: map[string]string{}}
+
+	if err := dbStatus(); err != nil {
+		report.Ready = false
+		report.Checks["database"] = err.Error()
+	} else {
+		report.Checks["database"] = "ok"
+		if pending := pendingMigrations(); len(pending) > 0 {
+			report.Ready = false
+			b, _ := json.Marshal(pending)
+			report.Checks["migrations"] = "pending: " + string(b)
+		} else {
+			report.Checks["migrations"] = "ok"
+		}
+	}
+
+	if r.FormValue("catalog") == "true" {
+		if catalog.Breaker.Open() {
+			report.Ready = false
+			report.Checks["catalog"] = errCatalogUnavailable.Error()
+		} else if err := catalog.Probe(r.Context()); err != nil && catalogErrorStatus(err) != http.StatusNotFound {
+			report.Ready = false
+			report.Checks["catalog"] = err.Error()
+		} else {
+			report.Checks["catalog"] = "ok"
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if !report.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+var errInvalidISBN = errors.New("invalid ISBN: expected 10 or 13 digits with a valid check digit")
+
+// normalizeISBN strips hyphens and spaces from an ISBN-10 or ISBN-13, verifies
+// its check digit and returns it in ISBN-13 form.
+func normalizeISBN(s string) (string, error) {
+	isbn := strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(s))
+
+	switch len(isbn) {
+	case 10:
+		if !validISBN10(isbn) {
+			return "", errInvalidISBN
+		}
+		return isbn10To13(isbn), nil
+	case 13:
+		if !validISBN13(isbn) {
+			return "", errInvalidISBN
+		}
+		return isbn, nil
+	}
+	return "", errInvalidISBN
+}
+
+func validISBN10(isbn string) bool {
+	if len(isbn) != 10 {
+		return false
+	}
+	sum := 0
+	for i, c := range isbn {
+		var d int
+		if c >= '0' && c <= '9' {
+			d = int(c - '0')
+		} else if c == 'X' && i == 9 {
+			d = 10
+		} else {
+			return false
+		}
+		sum += (10 - i) * d
+	}
+	return sum%11 == 0
+}
+
+func validISBN13(isbn string) bool {
+	if len(isbn) != 13 {
+		return false
+	}
+	for _, c := range isbn {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return isbn13CheckDigit(isbn[:12]) == isbn[12]
+}
+
+func isbn10CheckDigit(first9 string) byte {
+	sum := 0
+	for i := 0; i < 9; i++ {
+		sum += (10 - i) * int(first9[i]-'0')
+	}
+	d := (11 - sum%11) % 11
+	if d == 10 {
+		return 'X'
+	}
+	return byte('0' + d)
+}
+
+func isbn13CheckDigit(first12 string) byte {
+	sum := 0
+	for i := 0; i < 12; i++ {
+		d := int(first12[i] - '0')
+		if i%2 == 1 {
+			d *= 3
+		}
+		sum += d
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+// isbn10To13 converts a valid ISBN-10 to its 978-prefixed ISBN-13.
+func isbn10To13(isbn string) string {
+	body := "978" + isbn[:9]
+	return body + string(isbn13CheckDigit(body))
+}
+
+// isbn13To10 converts a valid ISBN-13 to ISBN-10. Only 978-prefixed numbers
+// have an ISBN-10 equivalent; ok is false for anything else.
+func isbn13To10(isbn string) (string, bool) {
+	if !strings.HasPrefix(isbn, "978") {
+		return "", false
+	}
+	body := isbn[3:12]
+	return body + string(isbn10CheckDigit(body)), true
+}
+
+// isbnForms returns the forms to look a normalised ISBN up by, ISBN-13 first.
+// Older catalog records are often indexed by their ISBN-10 only.
+func isbnForms(isbn string) []string {
+	if isbn10, ok := isbn13To10(isbn); ok {
+		return []string{isbn, isbn10}
+	}
+	return []string{isbn}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeISBN(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"9780345391803", "9780345391803", true},
+		{"978-0-345-39180-3", "9780345391803", true},
+		{"978 0 345 39180 3", "9780345391803", true},
+		{"0345391802", "9780345391803", true},
+		{"0-345-39180-2", "9780345391803", true},
+		{"080442957X", "9780804429573", true},
+		{"080442957x", "9780804429573", true},
+		{"9791032300824", "9791032300824", true},
+
+		{"", "", false},
+		{"9780345391804", "", false},
+		{"0345391803", "", false},
+		{"X804429570", "", false},
+		{"97803453918X3", "", false},
+		{"034539180", "", false},
+		{"97803453918033", "", false},
+		{"abcdefghij", "", false},
+	}
+	for _, tt := range tests {
+		got, err := normalizeISBN(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("normalizeISBN(%q) error = %v, want ok %v", tt.in, err, tt.ok)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("normalizeISBN(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestISBNCheckDigits(t *testing.T) {
+	tests := []struct {
+		isbn string
+		want byte
+	}{
+		{"034539180", '2'},
+		{"080442957", 'X'},
+		{"000000000", '0'},
+	}
+	for _, tt := range tests {
+		if got := isbn10CheckDigit(tt.isbn); got != tt.want {
+			t.Errorf("isbn10CheckDigit(%q) = %q, want %q", tt.isbn, got, tt.want)
+		}
+	}
+
+	tests = []struct {
+		isbn string
+		want byte
+	}{
+		{"978034539180", '3'},
+		{"978080442957", '3'},
+		{"979103230082", '4'},
+	}
+	for _, tt := range tests {
+		if got := isbn13CheckDigit(tt.isbn); got != tt.want {
+			t.Errorf("isbn13CheckDigit(%q) = %q, want %q", tt.isbn, got, tt.want)
+		}
+	}
+}
+
+func TestISBNConversion(t *testing.T) {
+	tests := []struct {
+		isbn10 string
+		isbn13 string
+	}{
+		{"0345391802", "9780345391803"},
+		{"080442957X", "9780804429573"},
+		{"0306406152", "9780306406157"},
+	}
+	for _, tt := range tests {
+		if got := isbn10To13(tt.isbn10); got != tt.isbn13 {
+			t.Errorf("isbn10To13(%q) = %q, want %q", tt.isbn10, got, tt.isbn13)
+		}
+		if got, ok := isbn13To10(tt.isbn13); !ok || got != tt.isbn10 {
+			t.Errorf("isbn13To10(%q) = %q, %v, want %q, true", tt.isbn13, got, ok, tt.isbn10)
+		}
+	}
+
+	if got, ok := isbn13To10("9791032300824"); ok {
+		t.Errorf("isbn13To10 of a 979 ISBN = %q, want no ISBN-10", got)
+	}
+}
+
+func TestISBNForms(t *testing.T) {
+	tests := []struct {
+		isbn string
+		want []string
+	}{
+		{"9780345391803", []string{"9780345391803", "0345391802"}},
+		{"9791032300824", []string{"9791032300824"}},
+	}
+	for _, tt := range tests {
+		if got := isbnForms(tt.isbn); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("isbnForms(%q) = %q, want %q", tt.isbn, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/larryprice/go-for-web-dev/Godeps/_workspace/src/github.com/urfave/negroni"
+)
+
+var logger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+type requestLogKey struct{}
+
+// requestLog collects what the handlers learn about a request so the access
+// log line can include it.
+type requestLog struct {
+	ID    string
+	User  string
+	Route string
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestLogFrom returns the log record attached to ctx, or an empty one.
+func requestLogFrom(ctx context.Context) *requestLog {
+	if rl, ok := ctx.Value(requestLogKey{}).(*requestLog); ok {
+		return rl
+	}
+	return &requestLog{}
+}
+
+// loggerFor returns a logger tagged with the request ID carried by ctx.
+func loggerFor(ctx context.Context) *slog.Logger {
+	if rl := requestLogFrom(ctx); rl.ID != "" {
+		return logger.With("request_id", rl.ID)
+	}
+	return logger
+}
+
+// errorCapture keeps the start of error response bodies, which is where
+// handlers put the message passed to http.Error.
+type errorCapture struct {
+	negroni.ResponseWriter
+	body []byte
+}
+
+func (w *errorCapture) Write(b []byte) (int, error) {
+	if w.Status() >= 400 && len(w.body) < 512 {
+		w.body = append(w.body, b...)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// requestLogger assigns every request an ID (reusing X-Request-ID when the
+// client sends one) and writes a JSON access log line when it completes.
+func requestLogger(mux *router) negroni.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		start := time.Now()
+
+		rl := &requestLog{ID: r.Header.Get("X-Request-ID"), Route: mux.routeTemplate(r)}
+		if rl.ID == "" || len(rl.ID) > 64 {
+			rl.ID = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", rl.ID)
+		r = r.WithContext(context.WithValue(r.Context(), requestLogKey{}, rl))
+
+		rw := &errorCapture{ResponseWriter: w.(negroni.ResponseWriter)}
+		next(rw, r)
+
+		attrs := []any{
+			"request_id", rl.ID,
+			"method", r.Method,
+			"path", redactPath(r.URL.Path),
+			"route", rl.Route,
+			"status", rw.Status(),
+			"bytes", rw.Size(),
+			"duration_ms", float64(time.Since(start).Microseconds()) / 1000,
+			"remote", r.RemoteAddr,
+		}
+		if rl.User != "" {
+			attrs = append(attrs, "user", rl.User)
+		}
+
+		level := slog.LevelInfo
+		if rw.Status() >= 500 {
+			level = slog.LevelError
+		} else if rw.Status() >= 400 {
+			level = slog.LevelWarn
+		}
+		if len(rw.body) > 0 {
+			attrs = append(attrs, "error", strings.TrimSpace(string(rw.body)))
+		}
+		logger.Log(r.Context(), level, "request", attrs...)
+	}
+}
+
+// secretPathPrefixes are followed by a path segment that grants access on
+// its own: a feed token or a share slug.
+var secretPathPrefixes = []string{"/feeds/", "/shared/"}
+
+// redactPath hides the secret segment of feed and share URLs so that the
+// access log does not hand out access to whoever can read it.
+func redactPath(path string) string {
+	for _, prefix := range secretPathPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			rest := path[len(prefix):]
+			if i := strings.IndexByte(rest, '/'); i >= 0 {
+				return prefix + "[redacted]" + rest[i:]
+			}
+			return prefix + "[redacted]"
+		}
+	}
+	return path
+}
+
+// newRecovery is negroni's panic recovery middleware logging through logger.
+func newRecovery() *negroni.Recovery {
+	rec := negroni.NewRecovery()
+	rec.Logger = slog.NewLogLogger(logger.Handler(), slog.LevelError)
+	rec.PrintStack = !cfg.production()
+	return rec
+}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestRedactPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/books", "/books"},
+		{"/books/12/cover", "/books/12/cover"},
+		{"/feeds/0123456789abcdef/books.atom", "/feeds/[redacted]/books.atom"},
+		{"/shared/s3cr3t", "/shared/[redacted]"},
+		{"/shared/s3cr3t/books/12/cover/thumb", "/shared/[redacted]/books/12/cover/thumb"},
+		{"/feeds/", "/feeds/[redacted]"},
+		{"/feedsx/abc", "/feedsx/abc"},
+	}
+	for _, tt := range tests {
+		if got := redactPath(tt.path); got != tt.want {
+			t.Errorf("redactPath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"net/http"
 
 	"database/sql"
@@ -10,17 +11,18 @@ import (
 
 	"encoding/json"
 	"encoding/xml"
+	"fmt"
 	"github.com/larryprice/go-for-web-dev/Godeps/_workspace/src/golang.org/x/crypto/bcrypt"
-	"io/ioutil"
 	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/larryprice/go-for-web-dev/Godeps/_workspace/src/github.com/urfave/negroni"
 	"github.com/larryprice/go-for-web-dev/Godeps/_workspace/src/github.com/goincremental/negroni-sessions"
 	"github.com/larryprice/go-for-web-dev/Godeps/_workspace/src/github.com/goincremental/negroni-sessions/cookiestore"
 	gmux "github.com/larryprice/go-for-web-dev/Godeps/_workspace/src/github.com/gorilla/mux"
-	"github.com/larryprice/go-for-web-dev/Godeps/_workspace/src/github.com/yosssi/ace"
 )
 
 type Book struct {
@@ -28,19 +30,44 @@ type Book struct {
 	Title          string `db:"title"`
 	Author         string `db:"author"`
 	Classification string `db:"classification"`
+	LCC            string `db:"lcc"`
+	Year           string `db:"year"`
 	ID             string `db:"id"`
 	User           string `db:"user"`
+	ISBN           string `db:"isbn"`
+	Cover          string `db:"cover"`
+	DeletedAt      int64  `db:"deleted_at"`
+
+	// CallNumberOverride replaces the generated CallNumber when set.
+	CallNumberOverride string `db:"call_number"`
+	CallNumber         string `db:"-"`
+
+	// Actor is who is responsible for the change being written, for the
+	// audit log. It defaults to the book's owner.
+	Actor    string `db:"-" json:"-"`
+	previous *Book  `db:"-"`
 }
 
 type User struct {
-	Username string `db:"username"`
-	Secret   []byte `db:"secret"`
+	Username  string `db:"username"`
+	Secret    []byte `db:"secret"`
+	// Scheme predates Preferences and is only read for users who have
+	// never saved their preferences.
+	Scheme    string `db:"scheme"`
+	FeedToken string `db:"feed_token"`
 }
 
 type Page struct {
 	Books  []Book
 	Filter string
 	User   string
+	Scheme string
+	Query  string
+	Sort   string
+
+	PageSize int
+	Total    int
+	Theme    string
 }
 
 type SearchResult struct {
@@ -54,44 +81,71 @@ var db *sql.DB
 var dbmap *gorp.DbMap
 
 func initDb() {
-	if os.Getenv("ENV") != "production" {
-		db, _ = sql.Open("sqlite3", "dev.db")
+	if !cfg.production() {
+		db, _ = sql.Open("sqlite3", cfg.SQLitePath)
 		dbmap = &gorp.DbMap{Db: db, Dialect: gorp.SqliteDialect{}}
 	} else {
-		db, _ = sql.Open("postgres", os.Getenv("DATABASE_URL"))
+		db, _ = sql.Open("postgres", cfg.DatabaseURL)
 		dbmap = &gorp.DbMap{Db: db, Dialect: gorp.PostgresDialect{}}
 	}
 
 	dbmap.AddTableWithName(Book{}, "books").SetKeys(true, "pk")
 	dbmap.AddTableWithName(User{}, "users").SetKeys(false, "username")
+	dbmap.AddTableWithName(AuditEntry{}, "audit_log").SetKeys(true, "pk")
+	dbmap.AddTableWithName(CatalogCacheEntry{}, "catalog_cache").SetKeys(false, "cache_key")
+	dbmap.AddTableWithName(Preferences{}, "preferences").SetKeys(false, "username")
+	dbmap.AddTableWithName(Share{}, "shares").SetKeys(false, "slug")
+	dbmap.AddTableWithName(Webhook{}, "webhooks").SetKeys(true, "pk")
+	dbmap.AddTableWithName(WebhookDelivery{}, "webhook_deliveries").SetKeys(true, "pk")
 	dbmap.CreateTablesIfNotExists()
-}
-
-func verifyDatabase(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
-	if err := db.Ping(); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	if err := migrateDb(); err != nil {
+		logger.Error("migrating the database failed", "error", err.Error())
+		os.Exit(1)
 	}
-	next(w, r)
 }
 
-func getBookCollection(books *[]Book, sortCol, filterByClass, username string, w http.ResponseWriter) bool {
-	if sortCol == "" {
-		sortCol = "pk"
+func getBookCollection(books *[]Book, prefs Preferences, w http.ResponseWriter) bool {
+	keys, err := parseSort(prefs.Sort)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	match, err := parseClassFilter(prefs.Filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	where := " where \"user\"=" + dbmap.Dialect.BindVar(0) + " and deleted_at=0"
+	cond, args, err := compileQuery(prefs.Query, 1)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
 	}
-	where := " where \"user\"=" + dbmap.Dialect.BindVar(0)
-	if filterByClass == "fiction" {
-		where += " and classification between '800' and '900'"
-	} else if filterByClass == "nonfiction" {
-		where += " and classification not between '800' and '900'"
+	if cond != "" {
+		where += " and " + cond
 	}
-	if _, err := dbmap.Select(books, "select * from books"+where+" order by "+sortCol, username); err != nil {
+	args = append([]interface{}{prefs.Username}, args...)
+	if _, err := dbmap.Select(books, "select * from books"+where+" order by "+sortSQL(keys), args...); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return false
 	}
+	*books = filterBooks(*books, match)
+	setCallNumbers(*books, prefs.Scheme)
+	if needsGoSort(keys) {
+		sortBooks(*books, keys, prefs.Scheme)
+	}
 	return true
 }
 
+// pageOfBooks returns the page'th (from 1) run of size books.
+func pageOfBooks(books []Book, page, size int) []Book {
+	if page < 1 {
+		page = 1
+	}
+	start := min((page-1)*size, len(books))
+	return books[start:min(start+size, len(books))]
+}
+
 func getStringFromSession(r *http.Request, key string) string {
 	var strVal string
 	if val := sessions.GetSession(r).Get(key); val != nil {
@@ -100,14 +154,41 @@ func getStringFromSession(r *http.Request, key string) string {
 	return strVal
 }
 
+// publicPaths are served without a logged-in user.
+var publicPaths = map[string]bool{
+	"/login":   true,
+	"/metrics": true,
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+// publicPrefixes are served without a logged-in user too. Feeds are
+// authenticated by the token in their path and shared libraries by their
+// slug, and both only register GET routes.
+var publicPrefixes = []string{"/assets/", "/feeds/", "/shared/"}
+
+func isPublicPath(path string) bool {
+	if publicPaths[path] {
+		return true
+	}
+	for _, prefix := range publicPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
 func verifyUser(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
-	if r.URL.Path == "/login" {
+	if isPublicPath(r.URL.Path) {
 		next(w, r)
 		return
 	}
 
 	if username := getStringFromSession(r, "User"); username != "" {
 		if user, _ := dbmap.Get(User{}, username); user != nil {
+			requestLogFrom(r.Context()).User = username
+			markUserActive(username)
 			next(w, r)
 			return
 		}
@@ -117,18 +198,40 @@ func verifyUser(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 
 type LoginPage struct {
 	Error string
+	User  string
+	Theme string
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		runConfigCommand(os.Args[2:])
+		return
+	}
+
+	var err error
+	if cfg, _, err = loadConfig(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	initStorage()
 	initDb()
+	initCatalog()
+	initCatalogCache()
+	initCallNumbers()
+	initAssets()
+	initTemplates()
+	go purgeExpiredPeriodically()
+	go deliverWebhooksPeriodically()
+	go monitorDb()
 
-	mux := gmux.NewRouter()
+	mux := newRouter()
 
 	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
 		var p LoginPage
 		if r.FormValue("register") != "" {
 			secret, _ := bcrypt.GenerateFromPassword([]byte(r.FormValue("password")), bcrypt.DefaultCost)
-			user := User{r.FormValue("username"), secret}
+			user := User{Username: r.FormValue("username"), Secret: secret, FeedToken: newFeedToken()}
 			if err := dbmap.Insert(&user); err != nil {
 				p.Error = err.Error()
 			} else {
@@ -145,8 +248,10 @@ func main() {
 			} else {
 				u := user.(*User)
 				if err = bcrypt.CompareHashAndPassword(u.Secret, []byte(r.FormValue("password"))); err != nil {
+					recordAudit(dbmap, u.Username, "user.login_failed", 0, "")
 					p.Error = err.Error()
 				} else {
+					recordAudit(dbmap, u.Username, "user.login", 0, "")
 					sessions.GetSession(r).Set("User", u.Username)
 					http.Redirect(w, r, "/", http.StatusFound)
 					return
@@ -154,79 +259,64 @@ func main() {
 			}
 		}
 
-		template, err := ace.Load("templates/login", "", nil)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		if err = template.Execute(w, p); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+		renderTemplate(w, "login", p)
 	})
 
 	mux.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
+		recordAudit(dbmap, getStringFromSession(r, "User"), "user.logout", 0, "")
 		sessions.GetSession(r).Set("User", nil)
-		sessions.GetSession(r).Set("Filter", nil)
 
 		http.Redirect(w, r, "/login", http.StatusFound)
 	})
 
 	mux.HandleFunc("/books", func(w http.ResponseWriter, r *http.Request) {
-		var b []Book
-		if !getBookCollection(&b, getStringFromSession(r, "SortBy"), r.FormValue("filter"),
-			getStringFromSession(r, "User"), w) {
-			return
-		}
-
-		sessions.GetSession(r).Set("Filter", r.FormValue("filter"))
-
-		if err := json.NewEncoder(w).Encode(b); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		// Listing parameters given here become the user's new defaults.
+		saved := getPreferences(getStringFromSession(r, "User"))
+		prefs := saved
+		if err := updatePreferences(&prefs, r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-	}).Methods("GET").Queries("filter", "{filter:all|fiction|nonfiction}")
 
-	mux.HandleFunc("/books", func(w http.ResponseWriter, r *http.Request) {
 		var b []Book
-		if !getBookCollection(&b, r.FormValue("sortBy"), getStringFromSession(r, "Filter"),
-			getStringFromSession(r, "User"), w) {
+		if !getBookCollection(&b, prefs, w) {
 			return
 		}
-
-		sessions.GetSession(r).Set("SortBy", r.FormValue("sortBy"))
-
-		if err := json.NewEncoder(w).Encode(b); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		if prefs != saved {
+			if err := savePreferences(&prefs); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
 		}
-	}).Methods("GET").Queries("sortBy", "{sortBy:title|author|classification}")
 
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		template, err := ace.Load("templates/index", "", nil)
-		if err != nil {
+		page, _ := strconv.Atoi(r.FormValue("page"))
+		w.Header().Set("X-Total-Count", strconv.Itoa(len(b)))
+		if err := json.NewEncoder(w).Encode(pageOfBooks(b, page, prefs.PageSize)); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+	}).Methods("GET")
 
-		p := Page{Books: []Book{}, Filter: getStringFromSession(r, "Filter"), User: getStringFromSession(r, "User")}
-		if !getBookCollection(&p.Books, getStringFromSession(r, "SortBy"),
-			getStringFromSession(r, "Filter"), p.User, w) {
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		p := Page{Books: []Book{}, User: getStringFromSession(r, "User")}
+		prefs := getPreferences(p.User)
+		p.Filter, p.Scheme, p.Query, p.Sort = prefs.Filter, prefs.Scheme, prefs.Query, prefs.Sort
+		p.PageSize, p.Theme = prefs.PageSize, prefs.Theme
+		if !getBookCollection(&p.Books, prefs, w) {
 			return
 		}
+		p.Total = len(p.Books)
+		p.Books = pageOfBooks(p.Books, 1, prefs.PageSize)
 
-		if err = template.Execute(w, p); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
+		renderTemplate(w, "index", p)
 	}).Methods("GET")
 
 	mux.HandleFunc("/search", func(w http.ResponseWriter, r *http.Request) {
 		var results []SearchResult
 		var err error
 
-		if results, err = search(r.FormValue("search")); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if results, err = search(r.Context(), r.FormValue("search")); err != nil {
+			http.Error(w, err.Error(), catalogErrorStatus(err))
 			return
 		}
 
@@ -237,11 +327,49 @@ func main() {
 	}).Methods("POST")
 
 	mux.HandleFunc("/books", func(w http.ResponseWriter, r *http.Request) {
+		isbn, err := normalizeISBN(r.FormValue("isbn"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		var book ClassifyBookResponse
-		var err error
+		if book, err = findByISBN(r.Context(), isbn); err != nil {
+			http.Error(w, err.Error(), catalogErrorStatus(err))
+			return
+		}
+
+		b := Book{
+			PK:             -1,
+			Title:          book.BookData.Title,
+			Author:         book.BookData.Author,
+			Classification: book.Classification.MostPopular,
+			LCC:            book.LCC.MostPopular,
+			Year:           book.BookData.Year,
+			ID:             book.BookData.ID,
+			User:           getStringFromSession(r, "User"),
+			ISBN:           isbn,
+		}
+		if !insertBook(&b, w) {
+			return
+		}
+		fetchCoverInBackground(b, book.BookData.OCLC)
 
-		if book, err = find(r.FormValue("id")); err != nil {
+		if err := json.NewEncoder(w).Encode(b); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}).Methods("PUT").Queries("isbn", "{isbn}")
+
+	mux.HandleFunc("/books", func(w http.ResponseWriter, r *http.Request) {
+		var book ClassifyBookResponse
+		var err error
+
+		if rejectDuplicate(r.FormValue("id"), getStringFromSession(r, "User"), w) {
+			return
+		}
+
+		if book, err = find(r.Context(), r.FormValue("id")); err != nil {
+			http.Error(w, err.Error(), catalogErrorStatus(err))
 			return
 		}
 
@@ -250,45 +378,65 @@ func main() {
 			Title:          book.BookData.Title,
 			Author:         book.BookData.Author,
 			Classification: book.Classification.MostPopular,
+			LCC:            book.LCC.MostPopular,
+			Year:           book.BookData.Year,
 			ID:             r.FormValue("id"),
 			User:           getStringFromSession(r, "User"),
 		}
-		if err = dbmap.Insert(&b); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if !insertBook(&b, w) {
 			return
 		}
+		fetchCoverInBackground(b, book.BookData.OCLC)
 
 		if err := json.NewEncoder(w).Encode(b); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
 	}).Methods("PUT")
 
-	mux.HandleFunc("/books/{pk}", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/books/{pk:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
 		pk, _ := strconv.ParseInt(gmux.Vars(r)["pk"], 10, 64)
 		var b Book
-		q := "select * from books where pk=" + dbmap.Dialect.BindVar(0) + " and \"user\"=" + dbmap.Dialect.BindVar(1)
-		if err := dbmap.SelectOne(&b, q, pk, getStringFromSession(r, "User")); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+		if err := getUserBook(&b, pk, getStringFromSession(r, "User")); err == sql.ErrNoRows {
+			// Deleting again would restart the book's time in the trash.
+			http.Error(w, "No such book on the shelf", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
-		if _, err := dbmap.Delete(&b); err != nil {
+		b.DeletedAt = time.Now().Unix()
+		if err := updateBook(&b); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 		w.WriteHeader(http.StatusOK)
 	}).Methods("DELETE")
 
-	n := negroni.Classic()
-	n.Use(sessions.Sessions("go-for-web-dev", cookiestore.New([]byte("my-secret-123"))))
-	n.Use(negroni.HandlerFunc(verifyDatabase))
+	registerCoverRoutes(mux)
+	registerDuplicateRoutes(mux)
+	registerTrashRoutes(mux)
+	registerAuditRoutes(mux)
+	registerCatalogCacheRoutes(mux)
+	registerBatchRoutes(mux)
+	registerDeweyRoutes(mux)
+	registerCallNumberRoutes(mux)
+	registerPreferenceRoutes(mux)
+	registerStatsRoutes(mux)
+	registerFeedRoutes(mux)
+	registerShareRoutes(mux)
+	registerWebhookRoutes(mux)
+	registerAssetRoutes(mux)
+
+	mux.HandleFunc("/metrics", metricsHandler).Methods("GET")
+	mux.HandleFunc("/healthz", healthzHandler).Methods("GET", "HEAD")
+	mux.HandleFunc("/readyz", readyzHandler).Methods("GET", "HEAD")
+
+	n := negroni.New(newRecovery(), requestLogger(mux), negroni.HandlerFunc(recordMetrics))
+	n.Use(sessions.Sessions("go-for-web-dev", cookiestore.New([]byte(cfg.SessionSecret))))
 	n.Use(negroni.HandlerFunc(verifyUser))
 	n.UseHandler(mux)
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
-	}
-
-	n.Run(":" + port)
+	serve(n)
 }
 
 type ClassifySearchResponse struct {
@@ -300,45 +448,92 @@ type ClassifyBookResponse struct {
 		Title  string `xml:"title,attr"`
 		Author string `xml:"author,attr"`
 		ID     string `xml:"owi,attr"`
+		Year   string `xml:"hyr,attr"`
+		OCLC   string `xml:",chardata"`
 	} `xml:"work"`
 	Classification struct {
 		MostPopular string `xml:"sfa,attr"`
 	} `xml:"recommendations>ddc>mostPopular"`
+	LCC struct {
+		MostPopular string `xml:"sfa,attr"`
+	} `xml:"recommendations>lcc>mostPopular"`
 }
 
-func find(id string) (ClassifyBookResponse, error) {
+func find(ctx context.Context, id string) (ClassifyBookResponse, error) {
 	var c ClassifyBookResponse
-	body, err := classifyAPI("http://classify.oclc.org/classify2/Classify?summary=true&owi=" + url.QueryEscape(id))
+	err := catalogCache.lookup("owi:"+id, &c, func() (interface{}, error) {
+		var c ClassifyBookResponse
+		body, err := catalog.Get(ctx, "owi="+url.QueryEscape(id))
 
-	if err != nil {
-		return ClassifyBookResponse{}, err
-	}
+		if err != nil {
+			return nil, err
+		}
 
-	err = xml.Unmarshal(body, &c)
+		if err = xml.Unmarshal(body, &c); err != nil {
+			return nil, &catalogBadResponse{http.StatusOK, err.Error()}
+		}
+		if c.BookData.ID == "" {
+			return nil, errNotInCatalog
+		}
+		return c, nil
+	})
 	return c, err
 }
 
-func search(query string) ([]SearchResult, error) {
-	var c ClassifySearchResponse
-	body, err := classifyAPI("http://classify.oclc.org/classify2/Classify?summary=true&title=" + url.QueryEscape(query))
+// findByISBN looks up a single work by its ISBN, trying the ISBN-10 form when
+// the catalog knows nothing under the ISBN-13. When the ISBN maps to several
+// works the first (most widely held) one is used.
+func findByISBN(ctx context.Context, isbn string) (ClassifyBookResponse, error) {
+	var c ClassifyBookResponse
+	err := catalogCache.lookup("isbn:"+isbn, &c, func() (interface{}, error) {
+		for _, form := range isbnForms(isbn) {
+			var c ClassifyBookResponse
+			body, err := catalog.Get(ctx, "isbn="+url.QueryEscape(form))
 
-	if err != nil {
-		return []SearchResult{}, err
-	}
+			if err != nil {
+				return nil, err
+			}
 
-	err = xml.Unmarshal(body, &c)
-	return c.Results, err
-}
+			if err = xml.Unmarshal(body, &c); err != nil {
+				return nil, &catalogBadResponse{http.StatusOK, err.Error()}
+			}
+			if c.BookData.ID != "" {
+				return c, nil
+			}
 
-func classifyAPI(url string) ([]byte, error) {
-	var resp *http.Response
-	var err error
+			var works ClassifySearchResponse
+			if err = xml.Unmarshal(body, &works); err != nil {
+				return nil, &catalogBadResponse{http.StatusOK, err.Error()}
+			}
+			if len(works.Results) > 0 {
+				return find(ctx, works.Results[0].ID)
+			}
+		}
+		return nil, errNotInCatalog
+	})
+	return c, err
+}
 
-	if resp, err = http.Get(url); err != nil {
-		return []byte{}, err
-	}
+func search(ctx context.Context, query string) ([]SearchResult, error) {
+	var results []SearchResult
+	err := catalogCache.lookup("title:"+strings.ToLower(strings.TrimSpace(query)), &results, func() (interface{}, error) {
+		var c ClassifySearchResponse
+		body, err := catalog.Get(ctx, "title="+url.QueryEscape(query))
 
-	defer resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
 
-	return ioutil.ReadAll(resp.Body)
+		if err = xml.Unmarshal(body, &c); err != nil {
+			return nil, &catalogBadResponse{http.StatusOK, err.Error()}
+		}
+		if len(c.Results) == 0 {
+			return nil, errNotInCatalog
+		}
+		return c.Results, nil
+	})
+	if err == errNotInCatalog {
+		return []SearchResult{}, nil
+	}
+	return results, err
 }
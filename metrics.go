@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/larryprice/go-for-web-dev/Godeps/_workspace/src/github.com/urfave/negroni"
+)
+
+// A minimal implementation of the Prometheus text exposition format, enough
+// for labelled counters and histograms.
+
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+func (c *counterVec) Inc(labelValues ...string) {
+	c.mu.Lock()
+	c.values[strings.Join(labelValues, "\xff")]++
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(buf *bytes.Buffer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(buf, "%s%s %s\n", c.name, formatLabels(c.labels, key, ""), formatFloat(c.values[key]))
+	}
+}
+
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: defaultBuckets, series: map[string]*histogram{}}
+}
+
+func (h *histogramVec) Observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *histogramVec) write(buf *bytes.Buffer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		for i, upper := range h.buckets {
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, formatFloat(upper)), s.counts[i])
+		}
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "+Inf"), s.count)
+		fmt.Fprintf(buf, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key, ""), formatFloat(s.sum))
+		fmt.Fprintf(buf, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, ""), s.count)
+	}
+}
+
+func writeGauge(buf *bytes.Buffer, name, help string, v float64) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(v))
+}
+
+func writeCounter(buf *bytes.Buffer, name, help string, v float64) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s counter\n%s %s\n", name, help, name, name, formatFloat(v))
+}
+
+func formatLabels(names []string, key, le string) string {
+	var pairs []string
+	if len(names) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, names[i]+"="+strconv.Quote(v))
+		}
+	}
+	if le != "" {
+		pairs = append(pairs, "le="+strconv.Quote(le))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var (
+	httpRequests = newCounterVec("http_requests_total",
+		"HTTP requests by method, route template and status code.", "method", "route", "status")
+	httpDuration = newHistogramVec("http_request_duration_seconds",
+		"HTTP request latency by method and route template.", "method", "route")
+	catalogRequests = newCounterVec("catalog_requests_total",
+		"Requests to the catalog provider by outcome.", "outcome")
+	catalogDuration = newHistogramVec("catalog_request_duration_seconds",
+		"Latency of requests to the catalog provider by outcome.", "outcome")
+)
+
+// catalogOutcome labels the result of a catalog request for metrics.
+func catalogOutcome(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	switch catalogErrorStatus(err) {
+	case http.StatusServiceUnavailable:
+		return "circuit_open"
+	case http.StatusGatewayTimeout:
+		return "timeout"
+	case http.StatusBadGateway:
+		return "bad_response"
+	}
+	return "error"
+}
+
+// activeUsers records when each user was last seen, so the metrics can
+// report how many have been active recently. Sessions live in cookies, so
+// this is the closest the server can get to counting active sessions.
+var activeUsers = struct {
+	sync.Mutex
+	lastSeen map[string]time.Time
+}{lastSeen: map[string]time.Time{}}
+
+const activeUserWindow = 15 * time.Minute
+
+func markUserActive(username string) {
+	activeUsers.Lock()
+	activeUsers.lastSeen[username] = time.Now()
+	activeUsers.Unlock()
+}
+
+func countActiveUsers() int {
+	activeUsers.Lock()
+	defer activeUsers.Unlock()
+
+	cutoff := time.Now().Add(-activeUserWindow)
+	for user, seen := range activeUsers.lastSeen {
+		if seen.Before(cutoff) {
+			delete(activeUsers.lastSeen, user)
+		}
+	}
+	return len(activeUsers.lastSeen)
+}
+
+// recordMetrics counts and times every request by its route template. It
+// runs after requestLogger, which has already matched the route.
+func recordMetrics(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	start := time.Now()
+	next(w, r)
+
+	route := requestLogFrom(r.Context()).Route
+	if route == "" {
+		route = "unmatched"
+	}
+	status := w.(negroni.ResponseWriter).Status()
+	method := methodLabel(r.Method)
+	httpRequests.Inc(method, route, strconv.Itoa(status))
+	httpDuration.Observe(time.Since(start).Seconds(), method, route)
+}
+
+// standardMethods are counted under their own name. Clients can send any
+// token as a method, so everything else shares one series.
+var standardMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "PATCH": true,
+	"DELETE": true, "CONNECT": true, "OPTIONS": true, "TRACE": true,
+}
+
+func methodLabel(method string) string {
+	if standardMethods[method] {
+		return method
+	}
+	return "other"
+}
+
+// metricsHandler serves the metrics. When metrics.token is set, scrapers
+// must send it as a bearer token.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if token := cfg.MetricsToken; token != "" && r.Header.Get("Authorization") != "Bearer "+token {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var buf bytes.Buffer
+	httpRequests.write(&buf)
+	httpDuration.write(&buf)
+	catalogRequests.write(&buf)
+	catalogDuration.write(&buf)
+
+	cache := catalogCache.Stats()
+	writeCounter(&buf, "catalog_cache_hits_total", "Catalog cache hits, including negative hits.",
+		float64(cache.Hits+cache.NegativeHits))
+	writeCounter(&buf, "catalog_cache_misses_total", "Catalog cache misses.", float64(cache.Misses))
+	writeGauge(&buf, "catalog_circuit_open", "1 while the catalog circuit breaker is open.",
+		map[bool]float64{true: 1, false: 0}[catalog.Breaker.Open()])
+
+	stats := db.Stats()
+	writeGauge(&buf, "db_max_open_connections", "Maximum number of open database connections.",
+		float64(stats.MaxOpenConnections))
+	writeGauge(&buf, "db_open_connections", "Open database connections.", float64(stats.OpenConnections))
+	writeGauge(&buf, "db_in_use_connections", "Database connections in use.", float64(stats.InUse))
+	writeGauge(&buf, "db_idle_connections", "Idle database connections.", float64(stats.Idle))
+	writeCounter(&buf, "db_wait_count_total", "Times a query waited for a database connection.",
+		float64(stats.WaitCount))
+	writeCounter(&buf, "db_wait_duration_seconds_total", "Time spent waiting for database connections.",
+		stats.WaitDuration.Seconds())
+
+	if users, err := dbmap.SelectInt("select count(*) from users"); err == nil {
+		writeGauge(&buf, "library_users", "Registered users.", float64(users))
+	}
+	writeGauge(&buf, "library_active_users", "Users seen in the last 15 minutes.", float64(countActiveUsers()))
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
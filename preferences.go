@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// Preferences are the per-user settings of the library view. They are kept
+// in the database so they survive logging out and follow the user between
+// devices.
+type Preferences struct {
+	Username string `db:"username" json:"-"`
+	Sort     string `db:"sort"`
+	Filter   string `db:"filter"`
+	Query    string `db:"query"`
+	PageSize int    `db:"page_size"`
+	Scheme   string `db:"scheme"`
+	Theme    string `db:"theme"`
+}
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 1000
+)
+
+var themes = map[string]bool{"light": true, "dark": true}
+
+func defaultPreferences(username string) Preferences {
+	return Preferences{Username: username, Filter: "all", PageSize: defaultPageSize, Scheme: schemeDewey, Theme: "light"}
+}
+
+// getPreferences loads the preferences of username, falling back to the
+// defaults for users who have never changed them. The classification scheme
+// used to live on the user, so it is carried over from there.
+func getPreferences(username string) Preferences {
+	if obj, _ := dbmap.Get(Preferences{}, username); obj != nil {
+		return *obj.(*Preferences)
+	}
+
+	p := defaultPreferences(username)
+	if user, _ := dbmap.Get(User{}, username); user != nil && user.(*User).Scheme == schemeLCC {
+		p.Scheme = schemeLCC
+	}
+	return p
+}
+
+func savePreferences(p *Preferences) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+	n, err := dbmap.Update(p)
+	if err == nil && n == 0 {
+		err = dbmap.Insert(p)
+	}
+	return err
+}
+
+func (p *Preferences) validate() error {
+	if _, err := parseSort(p.Sort); err != nil {
+		return err
+	}
+	if _, err := parseClassFilter(p.Filter); err != nil {
+		return err
+	}
+	if _, err := parseQuery(p.Query); err != nil {
+		return err
+	}
+	if p.PageSize < 1 || p.PageSize > maxPageSize {
+		return errors.New("page size must be between 1 and " + strconv.Itoa(maxPageSize))
+	}
+	if p.Scheme != schemeDewey && p.Scheme != schemeLCC {
+		return errors.New("scheme must be ddc or lcc")
+	}
+	if !themes[p.Theme] {
+		return errors.New("theme must be light or dark")
+	}
+	return nil
+}
+
+// updatePreferences applies the preference fields present in the request's
+// form to p. The listing parameters sortBy (single column, kept for older
+// clients), sort, filter and q use the same names as on /books.
+func updatePreferences(p *Preferences, r *http.Request) error {
+	r.ParseForm()
+	if v, ok := r.Form["sortBy"]; ok {
+		p.Sort = v[0]
+	}
+	if v, ok := r.Form["sort"]; ok {
+		p.Sort = v[0]
+	}
+	if v, ok := r.Form["filter"]; ok {
+		p.Filter = v[0]
+	}
+	if v, ok := r.Form["q"]; ok {
+		p.Query = v[0]
+	}
+	if v, ok := r.Form["pageSize"]; ok {
+		size, err := strconv.Atoi(v[0])
+		if err != nil {
+			return errors.New("page size must be a number")
+		}
+		p.PageSize = size
+	}
+	if v, ok := r.Form["scheme"]; ok {
+		p.Scheme = v[0]
+	}
+	if v, ok := r.Form["theme"]; ok {
+		p.Theme = v[0]
+	}
+	return p.validate()
+}
+
+// listAllPreferences are the user's preferences with the listing reset, for
+// callers that need every book.
+func listAllPreferences(username string) Preferences {
+	p := getPreferences(username)
+	p.Sort, p.Filter, p.Query = "", "all", ""
+	return p
+}
+
+// userScheme returns the primary classification scheme chosen by username.
+func userScheme(username string) string {
+	return getPreferences(username).Scheme
+}
+
+type SettingsPage struct {
+	Preferences Preferences
+	FeedURL     string
+	User        string
+	Theme       string
+}
+
+func registerPreferenceRoutes(mux *router) {
+	mux.HandleFunc("/preferences", func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewEncoder(w).Encode(getPreferences(getStringFromSession(r, "User"))); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}).Methods("GET")
+
+	mux.HandleFunc("/preferences", func(w http.ResponseWriter, r *http.Request) {
+		p := getPreferences(getStringFromSession(r, "User"))
+		if err := updatePreferences(&p, r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := savePreferences(&p); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(p); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}).Methods("PUT")
+
+	mux.HandleFunc("/settings", func(w http.ResponseWriter, r *http.Request) {
+		p := SettingsPage{User: getStringFromSession(r, "User")}
+		p.Preferences = getPreferences(p.User)
+		p.Theme = p.Preferences.Theme
+		token, err := ensureFeedToken(p.User)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		p.FeedURL = baseURL(r) + "/feeds/" + token
+		renderTemplate(w, "settings", p)
+	}).Methods("GET")
+}
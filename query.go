@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// The book listing accepts a small query language:
+//
+//	tolkien author:"le guin" -title:silmarillion class:800..899 year:1950..1960
+//
+// Terms are separated by spaces and all have to match. A term is a bare word,
+// matched against title and author, or field:value. Values containing spaces
+// are quoted, and a leading "-" negates a term. class and year take either a
+// single value or an inclusive from..to range; class and lcc also match by
+// prefix, so class:81 finds 810-819.
+
+// queryError reports where in the query parsing failed.
+type queryError struct {
+	Pos int
+	Msg string
+}
+
+func (e *queryError) Error() string {
+	return fmt.Sprintf("query error at character %d: %s", e.Pos+1, e.Msg)
+}
+
+type queryTerm struct {
+	Pos    int
+	Negate bool
+	Field  string
+	Value  string
+}
+
+// queryFields compiles a field:value term into a SQL condition with "?" in
+// place of each argument.
+var queryFields = map[string]func(t queryTerm) (string, []interface{}, error){
+	"title": func(t queryTerm) (string, []interface{}, error) {
+		return `lower(title) like ? escape '\'`, []interface{}{likeContains(t.Value)}, nil
+	},
+	"author": func(t queryTerm) (string, []interface{}, error) {
+		return `lower(author) like ? escape '\'`, []interface{}{likeContains(t.Value)}, nil
+	},
+	"isbn": func(t queryTerm) (string, []interface{}, error) {
+		digits := strings.Map(func(r rune) rune {
+			if r == 'x' || r == 'X' || unicode.IsDigit(r) {
+				return unicode.ToUpper(r)
+			}
+			return -1
+		}, t.Value)
+		if digits == "" {
+			return "", nil, &queryError{t.Pos, "isbn: expects digits"}
+		}
+		return "isbn like ?", []interface{}{"%" + digits + "%"}, nil
+	},
+	"class": func(t queryTerm) (string, []interface{}, error) {
+		value := deweyMarks.Replace(t.Value)
+		if from, to, ok := strings.Cut(value, ".."); ok {
+			if !queryDeweyPattern.MatchString(from) || !queryDeweyPattern.MatchString(to) {
+				return "", nil, &queryError{t.Pos, "class: range bounds must be Dewey numbers like 800 or 813.5"}
+			}
+			return deweyColumn + " >= ? and (" + deweyColumn + " <= ? or " + deweyColumn + " like ?)",
+				[]interface{}{from, to, to + "%"}, nil
+		}
+		if !queryDeweyPrefixPattern.MatchString(value) {
+			return "", nil, &queryError{t.Pos, "class: expects a Dewey number or range like 800..899"}
+		}
+		return deweyColumn + " like ?", []interface{}{value + "%"}, nil
+	},
+	"lcc": func(t queryTerm) (string, []interface{}, error) {
+		return `upper(lcc) like ? escape '\'`, []interface{}{likeEscape(strings.ToUpper(t.Value)) + "%"}, nil
+	},
+	"year": func(t queryTerm) (string, []interface{}, error) {
+		from, to, ok := strings.Cut(t.Value, "..")
+		if !ok {
+			to = from
+		}
+		if !queryYearPattern.MatchString(from) || !queryYearPattern.MatchString(to) {
+			return "", nil, &queryError{t.Pos, "year: expects a year or range like 1950..1960"}
+		}
+		return "year >= ? and year <= ?", []interface{}{from, to}, nil
+	},
+}
+
+// deweyColumn is the classification with its segmentation marks removed in
+// SQL, the way deweyNumber removes them, so that class:813.5 matches
+// "813/.54" just as the ddc:813.5 filter does.
+const deweyColumn = `replace(replace(trim(classification), '/', ''), '''', '')`
+
+var (
+	queryDeweyPattern       = regexp.MustCompile(`^\d{3}(\.\d+)?$`)
+	queryDeweyPrefixPattern = regexp.MustCompile(`^\d{1,3}(\.\d*)?$`)
+	queryYearPattern        = regexp.MustCompile(`^\d{4}$`)
+)
+
+func likeEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+func likeContains(s string) string {
+	return "%" + likeEscape(strings.ToLower(s)) + "%"
+}
+
+// parseQuery splits a query into its terms.
+func parseQuery(q string) ([]queryTerm, error) {
+	var terms []queryTerm
+	runes := []rune(q)
+	for i := 0; i < len(runes); {
+		if unicode.IsSpace(runes[i]) {
+			i++
+			continue
+		}
+
+		t := queryTerm{Pos: i}
+		if runes[i] == '-' {
+			t.Negate = true
+			i++
+			if i == len(runes) || unicode.IsSpace(runes[i]) {
+				return nil, &queryError{t.Pos, `"-" must be followed by a term`}
+			}
+		}
+
+		// A field name is a run of letters followed by a colon.
+		j := i
+		for j < len(runes) && unicode.IsLetter(runes[j]) {
+			j++
+		}
+		if j < len(runes) && runes[j] == ':' && j > i {
+			t.Field = strings.ToLower(string(runes[i:j]))
+			i = j + 1
+			if _, ok := queryFields[t.Field]; !ok {
+				return nil, &queryError{t.Pos, fmt.Sprintf("unknown field %q (known fields: %s)", t.Field, queryFieldNames())}
+			}
+		}
+
+		if i < len(runes) && runes[i] == '"' {
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			if end == len(runes) {
+				return nil, &queryError{i, "unterminated quote"}
+			}
+			t.Value = string(runes[i+1 : end])
+			i = end + 1
+		} else {
+			end := i
+			for end < len(runes) && !unicode.IsSpace(runes[end]) {
+				end++
+			}
+			t.Value = string(runes[i:end])
+			i = end
+		}
+		if strings.TrimSpace(t.Value) == "" {
+			if t.Field != "" {
+				return nil, &queryError{t.Pos, t.Field + ": missing value"}
+			}
+			return nil, &queryError{t.Pos, "empty term"}
+		}
+		terms = append(terms, t)
+	}
+	return terms, nil
+}
+
+func queryFieldNames() string {
+	var names []string
+	for name := range queryFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// compileQuery turns a query into a SQL condition on the books table. Bind
+// variables are numbered from firstArg so the condition can be appended to
+// a statement that already has arguments.
+func compileQuery(q string, firstArg int) (string, []interface{}, error) {
+	terms, err := parseQuery(q)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var conds []string
+	var args []interface{}
+	for _, t := range terms {
+		var cond string
+		var termArgs []interface{}
+		if t.Field == "" {
+			cond = `lower(title) like ? escape '\' or lower(author) like ? escape '\'`
+			termArgs = []interface{}{likeContains(t.Value), likeContains(t.Value)}
+		} else if cond, termArgs, err = queryFields[t.Field](t); err != nil {
+			return "", nil, err
+		}
+
+		// Replace the placeholders with the dialect's bind variables.
+		var sql strings.Builder
+		for _, part := range strings.SplitAfter(cond, "?") {
+			if strings.HasSuffix(part, "?") {
+				sql.WriteString(part[:len(part)-1] + dbmap.Dialect.BindVar(firstArg+len(args)))
+				args = append(args, termArgs[0])
+				termArgs = termArgs[1:]
+			} else {
+				sql.WriteString(part)
+			}
+		}
+
+		if t.Negate {
+			conds = append(conds, "not ("+sql.String()+")")
+		} else {
+			conds = append(conds, "("+sql.String()+")")
+		}
+	}
+	return strings.Join(conds, " and "), args, nil
+}
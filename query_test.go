@@ -0,0 +1,152 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/larryprice/go-for-web-dev/Godeps/_workspace/src/gopkg.in/gorp.v1"
+)
+
+// withDialect points dbmap at a database-less map using dialect for the
+// duration of a test.
+func withDialect(t *testing.T, dialect gorp.Dialect) {
+	saved := dbmap
+	dbmap = &gorp.DbMap{Dialect: dialect}
+	t.Cleanup(func() { dbmap = saved })
+}
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		q    string
+		want []queryTerm
+	}{
+		{"", nil},
+		{"   ", nil},
+		{"tolkien", []queryTerm{{0, false, "", "tolkien"}}},
+		{`author:"le guin"`, []queryTerm{{0, false, "author", "le guin"}}},
+		{"-title:silmarillion", []queryTerm{{0, true, "title", "silmarillion"}}},
+		{"Title:Dune", []queryTerm{{0, false, "title", "Dune"}}},
+		{`tolkien  -"the hobbit" year:1950..1960`, []queryTerm{
+			{0, false, "", "tolkien"},
+			{9, true, "", "the hobbit"},
+			{23, false, "year", "1950..1960"},
+		}},
+		{"9:30", []queryTerm{{0, false, "", "9:30"}}},
+		{"a-b", []queryTerm{{0, false, "", "a-b"}}},
+	}
+	for _, tt := range tests {
+		got, err := parseQuery(tt.q)
+		if err != nil {
+			t.Errorf("parseQuery(%q): %v", tt.q, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseQuery(%q) = %+v, want %+v", tt.q, got, tt.want)
+		}
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	tests := []struct {
+		q   string
+		pos int
+		msg string
+	}{
+		{"tolkien -", 8, `"-" must be followed by a term`},
+		{"- tolkien", 0, `"-" must be followed by a term`},
+		{"genre:fantasy", 0, `unknown field "genre"`},
+		{`author:"le guin`, 7, "unterminated quote"},
+		{"dune title:", 5, "title: missing value"},
+		{`""`, 0, "empty term"},
+	}
+	for _, tt := range tests {
+		_, err := parseQuery(tt.q)
+		qe, ok := err.(*queryError)
+		if !ok || qe.Pos != tt.pos || !strings.Contains(qe.Msg, tt.msg) {
+			t.Errorf("parseQuery(%q) error = %v, want %q at %d", tt.q, err, tt.msg, tt.pos)
+		}
+	}
+}
+
+func TestCompileQuery(t *testing.T) {
+	withDialect(t, gorp.PostgresDialect{})
+
+	tests := []struct {
+		q    string
+		sql  string
+		args []interface{}
+	}{
+		{"", "", nil},
+		{"tolkien",
+			`(lower(title) like $2 escape '\' or lower(author) like $3 escape '\')`,
+			[]interface{}{"%tolkien%", "%tolkien%"}},
+		{`-author:"Le Guin"`,
+			`not (lower(author) like $2 escape '\')`,
+			[]interface{}{"%le guin%"}},
+		{"title:100%_done",
+			`(lower(title) like $2 escape '\')`,
+			[]interface{}{`%100\%\_done%`}},
+		{"isbn:978-0-345",
+			"(isbn like $2)",
+			[]interface{}{"%9780345%"}},
+		{"class:81",
+			"(" + deweyColumn + " like $2)",
+			[]interface{}{"81%"}},
+		{"class:813/.5",
+			"(" + deweyColumn + " like $2)",
+			[]interface{}{"813.5%"}},
+		{"class:800..899",
+			"(" + deweyColumn + " >= $2 and (" + deweyColumn + " <= $3 or " + deweyColumn + " like $4))",
+			[]interface{}{"800", "899", "899%"}},
+		{"class:823'.9..823'.99",
+			"(" + deweyColumn + " >= $2 and (" + deweyColumn + " <= $3 or " + deweyColumn + " like $4))",
+			[]interface{}{"823.9", "823.99", "823.99%"}},
+		{"lcc:qa76",
+			`(upper(lcc) like $2 escape '\')`,
+			[]interface{}{"QA76%"}},
+		{"year:1950..1960 year:1955",
+			"(year >= $2 and year <= $3) and (year >= $4 and year <= $5)",
+			[]interface{}{"1950", "1960", "1955", "1955"}},
+	}
+	for _, tt := range tests {
+		sql, args, err := compileQuery(tt.q, 1)
+		if err != nil {
+			t.Errorf("compileQuery(%q): %v", tt.q, err)
+			continue
+		}
+		if sql != tt.sql || !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("compileQuery(%q) =\n  %s %q\nwant\n  %s %q", tt.q, sql, args, tt.sql, tt.args)
+		}
+	}
+}
+
+func TestCompileQuerySQLite(t *testing.T) {
+	withDialect(t, gorp.SqliteDialect{})
+
+	sql, args, err := compileQuery("dune year:1965", 1)
+	want := `(lower(title) like ? escape '\' or lower(author) like ? escape '\') and (year >= ? and year <= ?)`
+	if err != nil || sql != want || len(args) != 4 {
+		t.Errorf("compileQuery = %s %q, %v, want %s", sql, args, err, want)
+	}
+}
+
+func TestCompileQueryErrors(t *testing.T) {
+	withDialect(t, gorp.PostgresDialect{})
+
+	tests := []struct {
+		q   string
+		msg string
+	}{
+		{"isbn:abc", "isbn: expects digits"},
+		{"class:fiction", "class: expects a Dewey number"},
+		{"class:8..899", "class: range bounds must be Dewey numbers"},
+		{"year:1950s", "year: expects a year"},
+		{"dune year:1950..60", "year: expects a year"},
+	}
+	for _, tt := range tests {
+		if _, _, err := compileQuery(tt.q, 1); err == nil || !strings.Contains(err.Error(), tt.msg) {
+			t.Errorf("compileQuery(%q) error = %v, want %q", tt.q, err, tt.msg)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+
+	gmux "github.com/larryprice/go-for-web-dev/Godeps/_workspace/src/github.com/gorilla/mux"
+)
+
+// router is a gorilla mux Router that remembers the path template of every
+// route, which the vendored mux does not expose, so logs and metrics can
+// group requests by route.
+type router struct {
+	*gmux.Router
+	templates map[*gmux.Route]string
+}
+
+func newRouter() *router {
+	return &router{gmux.NewRouter(), map[*gmux.Route]string{}}
+}
+
+func (mux *router) HandleFunc(path string, f func(http.ResponseWriter, *http.Request)) *gmux.Route {
+	route := mux.Router.HandleFunc(path, f)
+	mux.templates[route] = path
+	return route
+}
+
+// routeTemplate returns the path template of the route matching r, or "" if
+// none does.
+func (mux *router) routeTemplate(r *http.Request) string {
+	var match gmux.RouteMatch
+	if mux.Match(r, &match) {
+		return mux.templates[match.Route]
+	}
+	return ""
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/larryprice/go-for-web-dev/Godeps/_workspace/src/gopkg.in/gorp.v1"
+)
+
+// columnMigration adds a column to a table created by an earlier release.
+// CreateTablesIfNotExists never alters existing tables, so every column added
+// to a mapped struct after its first release needs an entry here.
+type columnMigration struct {
+	Table      string
+	Column     string
+	Definition string
+}
+
+var columnMigrations = []columnMigration{
+	{"books", "isbn", "varchar(13) not null default ''"},
+	{"books", "cover", "varchar(16) not null default ''"},
+	{"books", "deleted_at", "bigint not null default 0"},
+	{"books", "lcc", "varchar(64) not null default ''"},
+	{"users", "scheme", "varchar(8) not null default 'ddc'"},
+	{"books", "year", "varchar(4) not null default ''"},
+	{"books", "call_number", "varchar(64) not null default ''"},
+	{"users", "feed_token", "varchar(32) not null default ''"},
+}
+
+// indexMigration creates an index, after the column migrations have run.
+type indexMigration struct {
+	Name   string
+	Create string
+}
+
+var indexMigrations = []indexMigration{
+	{"books_user_id", `create unique index if not exists books_user_id on books ("user", id)`},
+	{"webhook_deliveries_due", `create index if not exists webhook_deliveries_due on webhook_deliveries (status, next_attempt)`},
+}
+
+func migrateDb() error {
+	for _, m := range columnMigrations {
+		if err := ensureColumn(m); err != nil {
+			return err
+		}
+	}
+	if err := mergeDuplicateBooks(); err != nil {
+		return err
+	}
+	for _, m := range indexMigrations {
+		if _, err := db.Exec(m.Create); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func columnExists(m columnMigration) bool {
+	_, err := db.Exec("select " + dbmap.Dialect.QuoteField(m.Column) + " from " + m.Table + " limit 1")
+	return err == nil
+}
+
+func indexExists(m indexMigration) bool {
+	q := "select count(*) from sqlite_master where type='index' and name=" + dbmap.Dialect.BindVar(0)
+	if _, ok := dbmap.Dialect.(gorp.PostgresDialect); ok {
+		q = "select count(*) from pg_indexes where indexname=" + dbmap.Dialect.BindVar(0)
+	}
+	n, err := dbmap.SelectInt(q, m.Name)
+	return err == nil && n > 0
+}
+
+func ensureColumn(m columnMigration) error {
+	if columnExists(m) {
+		return nil
+	}
+	_, err := db.Exec("alter table " + m.Table + " add column " + dbmap.Dialect.QuoteField(m.Column) + " " + m.Definition)
+	return err
+}
+
+// mergeDuplicateBooks keeps one row of every work a user added more than once
+// before the unique books_user_id index existed, so that the index can be
+// created. The copy on the shelf with the lowest pk is kept and the others
+// are deleted, along with their covers.
+func mergeDuplicateBooks() error {
+	var dups []struct {
+		User string `db:"user"`
+		ID   string `db:"id"`
+	}
+	if _, err := dbmap.Select(&dups, `select "user", id from books group by "user", id having count(*)>1`); err != nil {
+		return err
+	}
+	if len(dups) == 0 {
+		return nil
+	}
+
+	tx, err := dbmap.Begin()
+	if err != nil {
+		return err
+	}
+	var removed []Book
+	for _, d := range dups {
+		var books []Book
+		q := "select * from books where \"user\"=" + dbmap.Dialect.BindVar(0) + " and id=" + dbmap.Dialect.BindVar(1) +
+			" order by case when deleted_at=0 then 0 else 1 end, pk"
+		if _, err := tx.Select(&books, q, d.User, d.ID); err != nil {
+			tx.Rollback()
+			return err
+		}
+		for _, b := range books[1:] {
+			if _, err := tx.Exec("delete from books where pk="+dbmap.Dialect.BindVar(0), b.PK); err != nil {
+				tx.Rollback()
+				return err
+			}
+			detail := "merged duplicate #" + strconv.FormatInt(b.PK, 10)
+			if err := recordAudit(tx, systemActor, "book.merge", books[0].PK, detail); err != nil {
+				tx.Rollback()
+				return err
+			}
+			logger.Warn("merged duplicate book", "user", d.User, "id", d.ID, "kept", books[0].PK, "removed", b.PK)
+			removed = append(removed, b)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for i := range removed {
+		deleteCover(&removed[i])
+	}
+	return nil
+}
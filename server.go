@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+}
+
+// redirectToHTTPS sends plain HTTP requests to the same URL on the TLS port.
+func redirectToHTTPS(tlsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if tlsPort != "443" {
+			host = net.JoinHostPort(host, tlsPort)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// serve runs the application until SIGINT or SIGTERM, then stops accepting
+// connections, waits up to server.shutdown_timeout for in-flight requests and closes
+// the database.
+func serve(handler http.Handler) {
+	var servers []*http.Server
+	errs := make(chan error, 2)
+	if cfg.TLSCertFile != "" {
+		app := newServer(":"+cfg.TLSPort, handler)
+		servers = append(servers, app)
+		go func() { errs <- app.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile) }()
+		logger.Info("listening", "addr", app.Addr, "tls", true)
+
+		if cfg.RedirectHTTP {
+			redirect := newServer(":"+cfg.Port, redirectToHTTPS(cfg.TLSPort))
+			servers = append(servers, redirect)
+			go func() { errs <- redirect.ListenAndServe() }()
+			logger.Info("redirecting to https", "addr", redirect.Addr)
+		}
+	} else {
+		app := newServer(":"+cfg.Port, handler)
+		servers = append(servers, app)
+		go func() { errs <- app.ListenAndServe() }()
+		logger.Info("listening", "addr", app.Addr, "tls", false)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	failed := false
+	select {
+	case err := <-errs:
+		logger.Error("server failed", "error", err.Error())
+		failed = true
+	case sig := <-stop:
+		logger.Info("shutting down", "signal", sig.String())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	for _, s := range servers {
+		if err := s.Shutdown(ctx); err != nil {
+			logger.Error("shutdown incomplete", "addr", s.Addr, "error", err.Error())
+		}
+	}
+	db.Close()
+	logger.Info("stopped")
+
+	if failed {
+		os.Exit(1)
+	}
+}
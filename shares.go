@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	gmux "github.com/larryprice/go-for-web-dev/Godeps/_workspace/src/github.com/gorilla/mux"
+)
+
+// Share is a public, read-only link to a user's library. Anyone with the
+// link can list the owner's books without logging in, until the owner
+// revokes it.
+type Share struct {
+	Slug      string `db:"slug"`
+	Username  string `db:"username" json:"-"`
+	Label     string `db:"label"`
+	CreatedAt int64  `db:"created_at"`
+}
+
+type SharedPage struct {
+	Slug     string
+	Owner    string
+	Books    []Book
+	Scheme   string
+	PageSize int
+	Total    int
+	User     string
+	Theme    string
+}
+
+func newShareSlug() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// getShare loads the share named by the request's slug, answering 404 when
+// there is none.
+func getShare(w http.ResponseWriter, r *http.Request) (*Share, bool) {
+	obj, err := dbmap.Get(Share{}, gmux.Vars(r)["slug"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	if obj == nil {
+		http.NotFound(w, r)
+		return nil, false
+	}
+	share := obj.(*Share)
+	requestLogFrom(r.Context()).User = share.Username
+	return share, true
+}
+
+// sharedPreferences are the owner's preferences with the listing taken from
+// the request alone, so visitors never see or change the owner's saved
+// filters.
+func sharedPreferences(share *Share, r *http.Request) (Preferences, error) {
+	p := listAllPreferences(share.Username)
+	err := updatePreferences(&p, r)
+	return p, err
+}
+
+func registerShareRoutes(mux *router) {
+	mux.HandleFunc("/shares", func(w http.ResponseWriter, r *http.Request) {
+		shares := []Share{}
+		if _, err := dbmap.Select(&shares, "select * from shares where username="+dbmap.Dialect.BindVar(0)+
+			" order by created_at", getStringFromSession(r, "User")); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(shares); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}).Methods("GET")
+
+	mux.HandleFunc("/shares", func(w http.ResponseWriter, r *http.Request) {
+		share := Share{
+			Slug:      newShareSlug(),
+			Username:  getStringFromSession(r, "User"),
+			Label:     r.FormValue("label"),
+			CreatedAt: time.Now().Unix(),
+		}
+		if err := dbmap.Insert(&share); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		recordAudit(dbmap, share.Username, "share.create", 0, share.Label)
+
+		if err := json.NewEncoder(w).Encode(share); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}).Methods("POST")
+
+	mux.HandleFunc("/shares/{slug}", func(w http.ResponseWriter, r *http.Request) {
+		username := getStringFromSession(r, "User")
+		res, err := dbmap.Exec("delete from shares where slug="+dbmap.Dialect.BindVar(0)+
+			" and username="+dbmap.Dialect.BindVar(1), gmux.Vars(r)["slug"], username)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		recordAudit(dbmap, username, "share.revoke", 0, "")
+		w.WriteHeader(http.StatusOK)
+	}).Methods("DELETE")
+
+	// The routes below are public; verifyUser lets /shared/ through.
+
+	mux.HandleFunc("/shared/{slug}", func(w http.ResponseWriter, r *http.Request) {
+		share, ok := getShare(w, r)
+		if !ok {
+			return
+		}
+		prefs := listAllPreferences(share.Username)
+		p := SharedPage{Slug: share.Slug, Owner: share.Username, Scheme: prefs.Scheme, PageSize: prefs.PageSize, Theme: prefs.Theme}
+		if !getBookCollection(&p.Books, prefs, w) {
+			return
+		}
+		p.Total = len(p.Books)
+		p.Books = pageOfBooks(p.Books, 1, prefs.PageSize)
+
+		renderTemplate(w, "shared", p)
+	}).Methods("GET")
+
+	mux.HandleFunc("/shared/{slug}/books", func(w http.ResponseWriter, r *http.Request) {
+		share, ok := getShare(w, r)
+		if !ok {
+			return
+		}
+		prefs, err := sharedPreferences(share, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var b []Book
+		if !getBookCollection(&b, prefs, w) {
+			return
+		}
+		page, _ := strconv.Atoi(r.FormValue("page"))
+		w.Header().Set("X-Total-Count", strconv.Itoa(len(b)))
+		if err := json.NewEncoder(w).Encode(pageOfBooks(b, page, prefs.PageSize)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}).Methods("GET")
+
+	mux.HandleFunc("/shared/{slug}/books/{pk:[0-9]+}/cover/thumb", func(w http.ResponseWriter, r *http.Request) {
+		if share, ok := getShare(w, r); ok {
+			serveCover(w, r, share.Username, thumbnailKey)
+		}
+	}).Methods("GET")
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// sortColumns are the keys accepted by the sort parameter and the SQL they
+// order by. Keys never reach SQL any other way. classification sorts by call
+// number, which has to happen in Go.
+var sortColumns = map[string]string{
+	"title":          "lower(title)",
+	"author":         "lower(author)",
+	"year":           "year",
+	"added":          "pk",
+	"classification": "",
+}
+
+// maxSortKeys bounds how many keys a listing is sorted by.
+const maxSortKeys = 4
+
+type sortKey struct {
+	Column string
+	Desc   bool
+}
+
+// parseSort reads a comma-separated list of keys, each optionally prefixed
+// with "-" for descending order, e.g. "author,-title". Books that tie on
+// every key stay in the order they were added.
+func parseSort(spec string) ([]sortKey, error) {
+	var keys []sortKey
+	seen := map[string]bool{}
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		key := sortKey{Column: field}
+		if strings.HasPrefix(field, "-") {
+			key = sortKey{Column: field[1:], Desc: true}
+		}
+		if _, ok := sortColumns[key.Column]; !ok {
+			return nil, fmt.Errorf("cannot sort by %q", key.Column)
+		}
+		if seen[key.Column] {
+			return nil, fmt.Errorf("%q appears twice in the sort order", key.Column)
+		}
+		seen[key.Column] = true
+		keys = append(keys, key)
+	}
+	if len(keys) > maxSortKeys {
+		return nil, fmt.Errorf("at most %d sort keys are allowed", maxSortKeys)
+	}
+	return keys, nil
+}
+
+// sortSQL builds the order by clause for keys, ending with pk so that the
+// order is stable. When the keys include a call number the books are only
+// ordered by pk here and sortBooks does the rest.
+func sortSQL(keys []sortKey) string {
+	if needsGoSort(keys) {
+		return "pk asc"
+	}
+	var order []string
+	for _, k := range keys {
+		dir := " asc"
+		if k.Desc {
+			dir = " desc"
+		}
+		order = append(order, sortColumns[k.Column]+dir)
+	}
+	return strings.Join(append(order, "pk asc"), ", ")
+}
+
+// needsGoSort reports whether the keys include a call number, which SQL
+// cannot order.
+func needsGoSort(keys []sortKey) bool {
+	for _, k := range keys {
+		if sortColumns[k.Column] == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// sortBooks orders books by keys, comparing call numbers in shelf order for
+// the scheme. books must already be ordered by pk.
+func sortBooks(books []Book, keys []sortKey, scheme string) {
+	compareCall := compareDewey
+	if scheme == schemeLCC {
+		compareCall = compareLCC
+	}
+
+	sort.SliceStable(books, func(i, j int) bool {
+		a, b := &books[i], &books[j]
+		for _, k := range keys {
+			var c int
+			switch k.Column {
+			case "title":
+				c = strings.Compare(strings.ToLower(a.Title), strings.ToLower(b.Title))
+			case "author":
+				c = strings.Compare(strings.ToLower(a.Author), strings.ToLower(b.Author))
+			case "year":
+				c = strings.Compare(a.Year, b.Year)
+			case "added":
+				c = int(a.PK - b.PK)
+			case "classification":
+				c = compareCall(a.CallNumber, b.CallNumber)
+			}
+			if k.Desc {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSort(t *testing.T) {
+	tests := []struct {
+		spec string
+		want []sortKey
+	}{
+		{"", nil},
+		{"title", []sortKey{{"title", false}}},
+		{"author,-title", []sortKey{{"author", false}, {"title", true}}},
+		{" -year , added ,", []sortKey{{"year", true}, {"added", false}}},
+		{"classification,author,title,year", []sortKey{
+			{"classification", false}, {"author", false}, {"title", false}, {"year", false},
+		}},
+	}
+	for _, tt := range tests {
+		got, err := parseSort(tt.spec)
+		if err != nil {
+			t.Errorf("parseSort(%q): %v", tt.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseSort(%q) = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestParseSortErrors(t *testing.T) {
+	tests := []struct {
+		spec string
+		want string
+	}{
+		{"pk", `cannot sort by "pk"`},
+		{"title;drop table books", `cannot sort by "title;drop table books"`},
+		{"--title", `cannot sort by "-title"`},
+		{"title,-title", `"title" appears twice`},
+		{"title,author,year,added,classification", "at most 4 sort keys"},
+	}
+	for _, tt := range tests {
+		if _, err := parseSort(tt.spec); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseSort(%q) error = %v, want %q", tt.spec, err, tt.want)
+		}
+	}
+}
+
+func TestSortSQL(t *testing.T) {
+	tests := []struct {
+		spec string
+		want string
+	}{
+		{"", "pk asc"},
+		{"author,-title", "lower(author) asc, lower(title) desc, pk asc"},
+		{"-added", "pk desc, pk asc"},
+		{"author,classification", "pk asc"},
+	}
+	for _, tt := range tests {
+		keys, _ := parseSort(tt.spec)
+		if got := sortSQL(keys); got != tt.want {
+			t.Errorf("sortSQL(%q) = %q, want %q", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestSortBooks(t *testing.T) {
+	books := []Book{
+		{PK: 1, Title: "Carrie", Author: "King", CallNumber: "813.54 K56c"},
+		{PK: 2, Title: "a Wizard of Earthsea", Author: "Le Guin", CallNumber: "813.54 L433w"},
+		{PK: 3, Title: "It", Author: "King", CallNumber: "813.54 K56i"},
+		{PK: 4, Title: "Dune", Author: "Herbert", CallNumber: "813.54 H536d"},
+		{PK: 5, Title: "The Hobbit", Author: "Tolkien", CallNumber: "823.912 T649h"},
+	}
+	tests := []struct {
+		spec string
+		want []int64
+	}{
+		{"title", []int64{2, 1, 4, 3, 5}},
+		{"author,-title", []int64{4, 3, 1, 2, 5}},
+		{"classification", []int64{4, 1, 3, 2, 5}},
+		{"-classification", []int64{5, 2, 3, 1, 4}},
+		// Ties keep the order the books were added in.
+		{"author", []int64{4, 1, 3, 2, 5}},
+	}
+	for _, tt := range tests {
+		keys, _ := parseSort(tt.spec)
+		sorted := append([]Book(nil), books...)
+		sortBooks(sorted, keys, schemeDewey)
+
+		var got []int64
+		for _, b := range sorted {
+			got = append(got, b.PK)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("sortBooks(%q) = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/larryprice/go-for-web-dev/Godeps/_workspace/src/gopkg.in/gorp.v1"
+)
+
+// LibraryStats summarises a user's collection.
+type LibraryStats struct {
+	Total        int64
+	WithCover    int64
+	InTrash      int64
+	Fiction      int
+	Nonfiction   int
+	Unclassified int
+	ByClass      []DeweyNode
+	TopAuthors   []StatCount
+	AddedByMonth []StatCount
+}
+
+// StatCount is one row of a grouped count.
+type StatCount struct {
+	Key   string `db:"k"`
+	Count int    `db:"n"`
+}
+
+type StatsPage struct {
+	Stats LibraryStats
+	User  string
+	Theme string
+}
+
+const topAuthorCount = 10
+
+// monthOf returns the SQL expression formatting a unix timestamp column as
+// YYYY-MM in the current dialect.
+func monthOf(column string) string {
+	if _, ok := dbmap.Dialect.(gorp.PostgresDialect); ok {
+		return "to_char(to_timestamp(" + column + "), 'YYYY-MM')"
+	}
+	return "strftime('%Y-%m', " + column + ", 'unixepoch')"
+}
+
+func getLibraryStats(stats *LibraryStats, username string, w http.ResponseWriter) bool {
+	bind := dbmap.Dialect.BindVar(0)
+	mine := ` from books where "user"=` + bind
+
+	totals := struct {
+		Total     int64 `db:"total"`
+		WithCover int64 `db:"with_cover"`
+		InTrash   int64 `db:"in_trash"`
+	}{}
+	err := dbmap.SelectOne(&totals, `select
+			coalesce(sum(case when deleted_at=0 then 1 else 0 end), 0) as total,
+			coalesce(sum(case when deleted_at=0 and cover<>'' then 1 else 0 end), 0) as with_cover,
+			coalesce(sum(case when deleted_at<>0 then 1 else 0 end), 0) as in_trash`+mine, username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	stats.Total, stats.WithCover, stats.InTrash = totals.Total, totals.WithCover, totals.InTrash
+
+	// Classifications are counted in SQL and folded into classes and the
+	// fiction split here, with the same rules as the listing's filters.
+	var classes []StatCount
+	if _, err := dbmap.Select(&classes, "select classification as k, count(*) as n"+mine+
+		" and deleted_at=0 group by classification", username); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	byClass := map[string]int{}
+	for _, c := range classes {
+		switch {
+		case isFiction(c.Key):
+			stats.Fiction += c.Count
+		case c.Key == "":
+			stats.Unclassified += c.Count
+		default:
+			stats.Nonfiction += c.Count
+		}
+		if n, ok := deweyNumber(c.Key); ok {
+			byClass[n[:1]] += c.Count
+		}
+	}
+	stats.ByClass = nil
+	for digit := '0'; digit <= '9'; digit++ {
+		stats.ByClass = append(stats.ByClass, newDeweyNode(string(digit), byClass))
+	}
+
+	stats.TopAuthors = []StatCount{}
+	if _, err := dbmap.Select(&stats.TopAuthors, "select author as k, count(*) as n"+mine+
+		" and deleted_at=0 group by author order by n desc, author limit "+strconv.Itoa(topAuthorCount), username); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	// Books keep no creation date, but every addition is in the audit log.
+	// Like the other figures this only counts books still on the shelf.
+	since := time.Now().AddDate(-1, 0, 0).Unix()
+	stats.AddedByMonth = []StatCount{}
+	if _, err := dbmap.Select(&stats.AddedByMonth, "select "+monthOf("a.at")+" as k, count(*) as n"+
+		" from audit_log a join books b on b.pk=a.book_pk"+
+		` where b."user"=`+bind+" and a.action='book.create' and b.deleted_at=0 and a.at>="+dbmap.Dialect.BindVar(1)+
+		" group by k order by k", username, since); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+func registerStatsRoutes(mux *router) {
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		p := StatsPage{User: getStringFromSession(r, "User")}
+		p.Theme = getPreferences(p.User).Theme
+		if !getLibraryStats(&p.Stats, p.User, w) {
+			return
+		}
+
+		if r.FormValue("format") == "json" {
+			if err := json.NewEncoder(w).Encode(p.Stats); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		renderTemplate(w, "stats", p)
+	}).Methods("GET")
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var errBlobNotFound = errors.New("blob not found")
+
+// blobStore persists opaque binary objects such as cover images.
+type blobStore interface {
+	Put(key string, data []byte, contentType string) error
+	Get(key string) ([]byte, string, error)
+	Delete(key string) error
+}
+
+var covers blobStore
+
+// initStorage picks the cover backend from the covers.store setting.
+func initStorage() {
+	if cfg.CoverStore == "s3" {
+		covers = &s3Store{
+			Endpoint:  strings.TrimRight(cfg.S3Endpoint, "/"),
+			Bucket:    cfg.S3Bucket,
+			Region:    cfg.S3Region,
+			AccessKey: cfg.S3AccessKey,
+			SecretKey: cfg.S3SecretKey,
+			Client:    &http.Client{Timeout: 30 * time.Second},
+		}
+		return
+	}
+
+	covers = localStore{Dir: cfg.CoverDir}
+}
+
+// localStore keeps blobs as files below Dir, with the content type in a
+// sidecar file.
+type localStore struct {
+	Dir string
+}
+
+func (s localStore) path(key string) string {
+	return filepath.Join(s.Dir, filepath.FromSlash(key))
+}
+
+func (s localStore) Put(key string, data []byte, contentType string) error {
+	p := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(p+".type", []byte(contentType), 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p, data, 0644)
+}
+
+func (s localStore) Get(key string) ([]byte, string, error) {
+	p := s.path(key)
+	data, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, "", errBlobNotFound
+	} else if err != nil {
+		return nil, "", err
+	}
+	contentType, _ := ioutil.ReadFile(p + ".type")
+	return data, string(contentType), nil
+}
+
+func (s localStore) Delete(key string) error {
+	p := s.path(key)
+	os.Remove(p + ".type")
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// s3Store talks to any S3-compatible service (AWS, MinIO, ...) using
+// path-style URLs and AWS Signature Version 4.
+type s3Store struct {
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	Client    *http.Client
+}
+
+func (s *s3Store) Put(key string, data []byte, contentType string) error {
+	resp, err := s.do("PUT", key, data, contentType)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Store) Get(key string) ([]byte, string, error) {
+	resp, err := s.do("GET", key, nil, "")
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	return data, resp.Header.Get("Content-Type"), err
+}
+
+func (s *s3Store) Delete(key string) error {
+	resp, err := s.do("DELETE", key, nil, "")
+	if err == errBlobNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Store) do(method, key string, body []byte, contentType string) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.Endpoint+"/"+s.Bucket+"/"+key, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	s.sign(req, body, time.Now().UTC())
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, errBlobNotFound
+	}
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", method, key, resp.Status, msg)
+	}
+	return resp, nil
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req.
+func (s *s3Store) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host + "\n" +
+			"x-amz-content-sha256:" + payloadHash + "\n" +
+			"x-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
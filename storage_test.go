@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testAccessKey = "AKIDEXAMPLE"
+	testSecretKey = "wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY"
+)
+
+func TestS3StoreSign(t *testing.T) {
+	s := &s3Store{Region: "us-east-1", AccessKey: testAccessKey, SecretKey: testSecretKey}
+	req, _ := http.NewRequest("PUT", "http://s3.example.com/books/covers/1", nil)
+	s.sign(req, []byte("cover"), time.Date(2013, 5, 24, 0, 0, 0, 0, time.UTC))
+
+	want := map[string]string{
+		"X-Amz-Date":           "20130524T000000Z",
+		"X-Amz-Content-Sha256": "3fa405a8301ace34d11cf44a816080b8f0e49a48fbd048b8aef1543a8c58bdb6",
+		"Authorization": "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20130524/us-east-1/s3/aws4_request, " +
+			"SignedHeaders=host;x-amz-content-sha256;x-amz-date, " +
+			"Signature=8d87282509ceb1fe95c878a272a001c98e2faac52abede91def80200f676e8cf",
+	}
+	for header, value := range want {
+		if got := req.Header.Get(header); got != value {
+			t.Errorf("%s = %q, want %q", header, got, value)
+		}
+	}
+}
+
+// fakeS3 is an in-memory stand-in for an S3 bucket that checks every request
+// is signed for the body it carries.
+type fakeS3 struct {
+	bucket string
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	types   map[string]string
+	methods []string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	if !f.verify(r, body) {
+		http.Error(w, "SignatureDoesNotMatch", http.StatusForbidden)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/"+f.bucket+"/") {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/"+f.bucket+"/")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.methods = append(f.methods, r.Method+" "+key)
+	switch r.Method {
+	case "PUT":
+		f.objects[key] = body
+		f.types[key] = r.Header.Get("Content-Type")
+	case "GET":
+		data, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", f.types[key])
+		w.Write(data)
+	case "DELETE":
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// verify recomputes the request's signature from what arrived on the wire.
+func (f *fakeS3) verify(r *http.Request, body []byte) bool {
+	if r.Header.Get("X-Amz-Content-Sha256") != sha256Hex(body) {
+		return false
+	}
+	when, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return false
+	}
+
+	signed, _ := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+	(&s3Store{Region: "us-east-1", AccessKey: testAccessKey, SecretKey: testSecretKey}).sign(signed, body, when)
+	return r.Header.Get("Authorization") == signed.Header.Get("Authorization")
+}
+
+func TestS3Store(t *testing.T) {
+	fake := &fakeS3{bucket: "books", objects: map[string][]byte{}, types: map[string]string{}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	s := &s3Store{
+		Endpoint:  srv.URL,
+		Bucket:    "books",
+		Region:    "us-east-1",
+		AccessKey: testAccessKey,
+		SecretKey: testSecretKey,
+		Client:    srv.Client(),
+	}
+
+	data, _ := hex.DecodeString("89504e470d0a1a0a")
+	if err := s.Put("covers/7", data, "image/png"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	got, contentType, err := s.Get("covers/7")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if !bytes.Equal(got, data) || contentType != "image/png" {
+		t.Errorf("Get = %x, %q, want %x, %q", got, contentType, data, "image/png")
+	}
+
+	if err := s.Delete("covers/7"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, _, err := s.Get("covers/7"); err != errBlobNotFound {
+		t.Errorf("Get after Delete: err = %v, want errBlobNotFound", err)
+	}
+	if err := s.Delete("covers/7"); err != nil {
+		t.Errorf("Delete of a missing key: %v", err)
+	}
+
+	want := []string{"PUT covers/7", "GET covers/7", "DELETE covers/7", "GET covers/7", "DELETE covers/7"}
+	if strings.Join(fake.methods, ", ") != strings.Join(want, ", ") {
+		t.Errorf("requests = %q, want %q", fake.methods, want)
+	}
+
+	s.SecretKey = "wrong"
+	if err := s.Put("covers/8", data, "image/png"); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("Put with a bad key: err = %v, want a 403", err)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/larryprice/go-for-web-dev/Godeps/_workspace/src/github.com/yosssi/ace"
+)
+
+// templateDir holds the ace sources within assets. Every page is an inner
+// template rendered into templates/layout.ace, which pulls in the shared
+// partials.
+const templateDir = "templates"
+
+var templatePages = []string{"index", "login", "audit", "settings", "stats", "shared", "webhooks"}
+
+var templateFuncs = template.FuncMap{
+	"formatTime":  formatUnix,
+	"asset":       assetURL,
+	"maxSortKeys": func() int { return maxSortKeys },
+}
+
+// templateRegistry keeps the compiled pages. They are compiled once at
+// startup; when assets.dir is set the directory is polled and the pages are
+// recompiled whenever a file changes.
+type templateRegistry struct {
+	mu    sync.RWMutex
+	pages map[string]*template.Template
+}
+
+var templates = &templateRegistry{}
+
+func initTemplates() {
+	if err := templates.compile(); err != nil {
+		logger.Error("compiling templates failed", "error", err.Error())
+		os.Exit(1)
+	}
+	if cfg.AssetDir != "" {
+		go templates.watch(time.Second)
+	}
+}
+
+// compile builds every page and swaps them in together. On error the
+// previously compiled pages stay in place.
+func (t *templateRegistry) compile() error {
+	pages := make(map[string]*template.Template, len(templatePages))
+	for _, name := range templatePages {
+		// DynamicReload keeps ace's own cache out of the way; caching is
+		// done here.
+		tpl, err := ace.Load("layout", name, &ace.Options{
+			BaseDir:       templateDir,
+			DynamicReload: true,
+			FuncMap:       templateFuncs,
+			Asset: func(name string) ([]byte, error) {
+				return fs.ReadFile(assets, filepath.ToSlash(name))
+			},
+		})
+		if err != nil {
+			return err
+		}
+		pages[name] = tpl
+	}
+
+	t.mu.Lock()
+	t.pages = pages
+	t.mu.Unlock()
+	return nil
+}
+
+// watch recompiles the templates and rehashes the static files whenever a
+// file in assets.dir is added, removed or modified.
+func (t *templateRegistry) watch(interval time.Duration) {
+	last := assetsModified()
+	for range time.Tick(interval) {
+		modified := assetsModified()
+		if modified.Equal(last) {
+			continue
+		}
+		last = modified
+
+		if err := hashAssets(); err != nil {
+			logger.Error("rehashing static assets failed", "error", err.Error())
+		}
+		if err := t.compile(); err != nil {
+			logger.Error("recompiling templates failed, keeping previous version", "error", err.Error())
+		} else {
+			logger.Info("templates recompiled")
+		}
+	}
+}
+
+// assetsModified returns the latest modification time of the templates and
+// static files, including the directories themselves so that deletions are
+// noticed.
+func assetsModified() time.Time {
+	var latest time.Time
+	for _, dir := range []string{templateDir, "public"} {
+		fs.WalkDir(assets, dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if info, err := d.Info(); err == nil && info.ModTime().After(latest) {
+				latest = info.ModTime()
+			}
+			return nil
+		})
+	}
+	return latest
+}
+
+func (t *templateRegistry) lookup(name string) *template.Template {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.pages[name]
+}
+
+// renderTemplate executes the named page into a buffer so that a failing
+// template produces a clean 500 instead of half a page.
+func renderTemplate(w http.ResponseWriter, name string, data interface{}) {
+	tpl := templates.lookup(name)
+	if tpl == nil {
+		http.Error(w, "unknown template "+name, http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
+}
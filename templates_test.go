@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestTemplatesCompile(t *testing.T) {
+	if err := templates.compile(); err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	for _, name := range templatePages {
+		if templates.lookup(name) == nil {
+			t.Errorf("page %q was not compiled", name)
+		}
+	}
+}
+
+// TestSortKeyLimit checks that the pages limit sort keys as the server does.
+func TestSortKeyLimit(t *testing.T) {
+	if err := templates.compile(); err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+
+	pages := map[string]interface{}{
+		"index":  Page{Books: []Book{}, PageSize: 50},
+		"shared": SharedPage{Slug: "abc", PageSize: 50},
+	}
+	for name, data := range pages {
+		w := httptest.NewRecorder()
+		renderTemplate(w, name, data)
+		body := w.Body.String()
+		if w.Code != 200 {
+			t.Fatalf("rendering %s: %d %s", name, w.Code, body)
+		}
+		// html/template pads numbers it writes into scripts with spaces.
+		if !regexp.MustCompile(`var maxSortKeys = \s*` + strconv.Itoa(maxSortKeys) + `\s*;`).MatchString(body) {
+			t.Errorf("%s does not take its sort key limit from maxSortKeys", name)
+		}
+		if strings.Contains(body, "slice(0, 3)") {
+			t.Errorf("%s still hard-codes a limit of 3 sort keys", name)
+		}
+	}
+}
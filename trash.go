@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	gmux "github.com/larryprice/go-for-web-dev/Godeps/_workspace/src/github.com/gorilla/mux"
+)
+
+func getTrashedBooks(books *[]Book, username string, w http.ResponseWriter) bool {
+	q := "select * from books where \"user\"=" + dbmap.Dialect.BindVar(0) + " and deleted_at<>0 order by deleted_at desc"
+	if _, err := dbmap.Select(books, q, username); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// purgeBooks permanently removes books and their covers.
+func purgeBooks(books []Book) error {
+	for i := range books {
+		if err := deleteBook(&books[i]); err != nil {
+			return err
+		}
+		deleteCover(&books[i])
+	}
+	return nil
+}
+
+// purgeExpiredTrash removes every book that has been in the trash for longer
+// than the trash.retention setting.
+func purgeExpiredTrash() error {
+	var books []Book
+	cutoff := time.Now().Add(-cfg.TrashRetention).Unix()
+	q := "select * from books where deleted_at<>0 and deleted_at<" + dbmap.Dialect.BindVar(0)
+	if _, err := dbmap.Select(&books, q, cutoff); err != nil {
+		return err
+	}
+	for i := range books {
+		books[i].Actor = systemActor
+	}
+	return purgeBooks(books)
+}
+
+// purgeExpiredPeriodically removes expired trash and catalog cache entries
+// once an hour.
+func purgeExpiredPeriodically() {
+	for {
+		if err := purgeExpiredTrash(); err != nil {
+			logger.Error("purging expired trash failed", "error", err.Error())
+		}
+		if err := catalogCache.purgeExpired(); err != nil {
+			logger.Error("purging expired catalog cache entries failed", "error", err.Error())
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+func registerTrashRoutes(mux *router) {
+	mux.HandleFunc("/books/trash", func(w http.ResponseWriter, r *http.Request) {
+		b := []Book{}
+		if !getTrashedBooks(&b, getStringFromSession(r, "User"), w) {
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(b); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}).Methods("GET")
+
+	mux.HandleFunc("/books/trash", func(w http.ResponseWriter, r *http.Request) {
+		var b []Book
+		if !getTrashedBooks(&b, getStringFromSession(r, "User"), w) {
+			return
+		}
+
+		if err := purgeBooks(b); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}).Methods("DELETE")
+
+	mux.HandleFunc("/books/trash/{pk:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
+		pk, _ := strconv.ParseInt(gmux.Vars(r)["pk"], 10, 64)
+		var b Book
+		if err := getTrashedBook(&b, pk, getStringFromSession(r, "User")); err != nil {
+			http.Error(w, "No such book in the trash", http.StatusNotFound)
+			return
+		}
+
+		if err := purgeBooks([]Book{b}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}).Methods("DELETE")
+
+	mux.HandleFunc("/books/{pk:[0-9]+}/restore", func(w http.ResponseWriter, r *http.Request) {
+		pk, _ := strconv.ParseInt(gmux.Vars(r)["pk"], 10, 64)
+		var b Book
+		if err := getTrashedBook(&b, pk, getStringFromSession(r, "User")); err != nil {
+			http.Error(w, "No such book in the trash", http.StatusNotFound)
+			return
+		}
+
+		b.DeletedAt = 0
+		if err := updateBook(&b); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		b.CallNumber = callNumber(&b, userScheme(b.User))
+
+		if err := json.NewEncoder(w).Encode(b); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}).Methods("POST")
+}
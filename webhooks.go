@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	gmux "github.com/larryprice/go-for-web-dev/Godeps/_workspace/src/github.com/gorilla/mux"
+	"github.com/larryprice/go-for-web-dev/Godeps/_workspace/src/gopkg.in/gorp.v1"
+)
+
+// Webhooks post library events to URLs chosen by the user. Events are queued
+// in webhook_deliveries by the Book hooks, inside the transaction that makes
+// the change (see createBook), so a delivery exists exactly when the change
+// does. A worker sends them in the background, retrying with exponential
+// backoff.
+
+// Webhook is a URL subscribed to some of the user's events. Every payload is
+// signed with Secret.
+type Webhook struct {
+	PK        int64  `db:"pk"`
+	Username  string `db:"username" json:"-"`
+	URL       string `db:"url"`
+	Secret    string `db:"secret"`
+	Events    string `db:"events"`
+	CreatedAt int64  `db:"created_at"`
+}
+
+// WebhookDelivery is one event queued for a webhook, and the outcome of the
+// latest attempt to send it.
+type WebhookDelivery struct {
+	PK           int64  `db:"pk"`
+	WebhookPK    int64  `db:"webhook_pk"`
+	Event        string `db:"event"`
+	Payload      string `db:"payload"`
+	Status       string `db:"status"`
+	Attempts     int    `db:"attempts"`
+	NextAttempt  int64  `db:"next_attempt"`
+	LastAttempt  int64  `db:"last_attempt"`
+	ResponseCode int    `db:"response_code"`
+	Error        string `db:"error"`
+	CreatedAt    int64  `db:"created_at"`
+}
+
+// WebhookPayload is the JSON body posted for an event.
+type WebhookPayload struct {
+	Event string
+	At    int64
+	Actor string
+	Book  *Book
+}
+
+type WebhooksPage struct {
+	Events []webhookEvent
+	User   string
+	Theme  string
+}
+
+type webhookEvent struct {
+	Name        string
+	Description string
+}
+
+// webhookEvents are the audit actions a webhook can subscribe to.
+var webhookEvents = []webhookEvent{
+	{"book.create", "A book is added"},
+	{"book.update", "A book is edited"},
+	{"book.trash", "A book is moved to the trash"},
+	{"book.restore", "A book is restored from the trash"},
+	{"book.delete", "A book is deleted permanently"},
+}
+
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+
+	webhookPollInterval = 5 * time.Second
+	webhookBatchSize    = 100
+	webhookWorkers      = 8
+	maxDeliveryError    = 500
+
+	// maxWebhookBackoff caps the wait between attempts however large
+	// webhooks.backoff and webhooks.max_attempts are.
+	maxWebhookBackoff = 24 * time.Hour
+)
+
+func isWebhookEvent(name string) bool {
+	for _, e := range webhookEvents {
+		if e.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Webhook) subscribes(event string) bool {
+	for _, e := range strings.Split(h.Events, ",") {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func newWebhookSecret() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// signPayload is the value of the X-Webhook-Signature header: the hex
+// HMAC-SHA256 of the body keyed with the webhook's secret.
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// queueWebhooks queues event about b for every webhook of the book's owner
+// that subscribes to it.
+func queueWebhooks(s gorp.SqlExecutor, event string, b *Book) error {
+	var hooks []Webhook
+	if _, err := s.Select(&hooks, "select * from webhooks where username="+dbmap.Dialect.BindVar(0), b.User); err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	var payload []byte
+	for i := range hooks {
+		if !hooks[i].subscribes(event) {
+			continue
+		}
+		if payload == nil {
+			var err error
+			if payload, err = json.Marshal(WebhookPayload{Event: event, At: now, Actor: b.actor(), Book: b}); err != nil {
+				return err
+			}
+		}
+		err := s.Insert(&WebhookDelivery{
+			WebhookPK:   hooks[i].PK,
+			Event:       event,
+			Payload:     string(payload),
+			Status:      deliveryPending,
+			NextAttempt: now,
+			CreatedAt:   now,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deliverWebhooksPeriodically() {
+	for {
+		if err := deliverDueWebhooks(); err != nil {
+			logger.Error("delivering webhooks failed", "error", err.Error())
+		}
+		time.Sleep(webhookPollInterval)
+	}
+}
+
+// deliverDueWebhooks sends every pending delivery whose next attempt is due.
+// The due deliveries of one webhook go out one at a time, oldest first, while
+// up to webhookWorkers webhooks are served at once, so that one slow endpoint
+// does not hold up everyone else's deliveries. Delivery is not strictly in
+// order: a failed delivery waiting for its retry does not hold back later
+// events to the same webhook.
+func deliverDueWebhooks() error {
+	var due []WebhookDelivery
+	q := "select * from webhook_deliveries where status=" + dbmap.Dialect.BindVar(0) +
+		" and next_attempt<=" + dbmap.Dialect.BindVar(1) + " order by pk limit " + strconv.Itoa(webhookBatchSize)
+	if _, err := dbmap.Select(&due, q, deliveryPending, time.Now().Unix()); err != nil {
+		return err
+	}
+
+	var hookPKs []int64
+	byHook := map[int64][]*WebhookDelivery{}
+	for i := range due {
+		pk := due[i].WebhookPK
+		if byHook[pk] == nil {
+			hookPKs = append(hookPKs, pk)
+		}
+		byHook[pk] = append(byHook[pk], &due[i])
+	}
+
+	queue := make(chan []*WebhookDelivery)
+	errs := make(chan error, len(hookPKs))
+	var wg sync.WaitGroup
+	for i := 0; i < min(webhookWorkers, len(hookPKs)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for deliveries := range queue {
+				if err := deliverInOrder(deliveries); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	for _, pk := range hookPKs {
+		queue <- byHook[pk]
+	}
+	close(queue)
+	wg.Wait()
+	close(errs)
+
+	// Report the first failure; the rest are retried on the next poll.
+	return <-errs
+}
+
+// deliverInOrder sends one webhook's deliveries, leasing each just before it
+// goes out.
+func deliverInOrder(deliveries []*WebhookDelivery) error {
+	for _, d := range deliveries {
+		leased, err := leaseDelivery(d)
+		if err != nil {
+			return err
+		}
+		if !leased {
+			continue
+		}
+		if err := deliverWebhook(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// leaseDelivery pushes d's next attempt past the request timeout, counted
+// from now, so another instance polling the same database skips d while it is
+// being sent. It reports false when another instance got there first.
+func leaseDelivery(d *WebhookDelivery) (bool, error) {
+	lease := time.Now().Unix() + int64(2*cfg.WebhookTimeout/time.Second) + 1
+	res, err := dbmap.Exec("update webhook_deliveries set next_attempt="+dbmap.Dialect.BindVar(0)+
+		" where pk="+dbmap.Dialect.BindVar(1)+" and next_attempt="+dbmap.Dialect.BindVar(2),
+		lease, d.PK, d.NextAttempt)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// deliverWebhook makes one attempt at d and records the outcome.
+func deliverWebhook(d *WebhookDelivery) error {
+	obj, err := dbmap.Get(Webhook{}, d.WebhookPK)
+	if err != nil {
+		return err
+	}
+
+	d.Attempts++
+	d.LastAttempt = time.Now().Unix()
+	d.ResponseCode, d.Error = 0, ""
+	if obj == nil {
+		d.Error = "webhook no longer exists"
+	} else if err := sendWebhook(obj.(*Webhook), d); err != nil {
+		d.Error = err.Error()
+		if len(d.Error) > maxDeliveryError {
+			d.Error = d.Error[:maxDeliveryError]
+		}
+	}
+
+	switch {
+	case d.Error == "":
+		d.Status = deliveryDelivered
+	case obj == nil || d.Attempts >= cfg.WebhookMaxAttempts:
+		d.Status = deliveryFailed
+	default:
+		d.NextAttempt = d.LastAttempt + int64(webhookBackoff(d.Attempts)/time.Second)
+	}
+	_, err = dbmap.Update(d)
+	return err
+}
+
+// webhookBackoff is the wait after a delivery's nth failed attempt: the
+// webhooks.backoff setting, doubled after each further failure up to
+// maxWebhookBackoff.
+func webhookBackoff(attempts int) time.Duration {
+	wait := min(cfg.WebhookBackoff, maxWebhookBackoff)
+	for i := 1; i < attempts && wait < maxWebhookBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, maxWebhookBackoff)
+}
+
+func sendWebhook(h *Webhook, d *WebhookDelivery) error {
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader([]byte(d.Payload)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-for-web-dev-webhooks")
+	req.Header.Set("X-Webhook-Event", d.Event)
+	req.Header.Set("X-Webhook-Delivery", strconv.FormatInt(d.PK, 10))
+	req.Header.Set("X-Webhook-Signature", signPayload(h.Secret, []byte(d.Payload)))
+
+	resp, err := webhookClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	d.ResponseCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("endpoint answered " + resp.Status)
+	}
+	return nil
+}
+
+var errWebhookAddress = errors.New("webhooks cannot be sent to loopback, private or link-local addresses")
+
+// webhookAddrAllowed decides which addresses webhooks may connect to. Users
+// choose the URLs, so without this they could reach the server's own
+// endpoints, the cloud metadata service or anything else on the internal
+// network, and read the outcome in the delivery log.
+var webhookAddrAllowed = isPublicAddr
+
+func isPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsValid() && !addr.IsUnspecified() && !addr.IsLoopback() && !addr.IsPrivate() &&
+		!addr.IsLinkLocalUnicast() && !addr.IsLinkLocalMulticast() && !addr.IsInterfaceLocalMulticast() &&
+		!addr.IsMulticast()
+}
+
+// webhookClient sends every delivery. Its dialer checks each address after
+// name resolution, so a hostname cannot be re-pointed between a check and the
+// connection, and it neither uses a proxy nor follows redirects, which would
+// both connect somewhere other than the checked address.
+var webhookClient = sync.OnceValue(func() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: cfg.WebhookTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			ap, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !webhookAddrAllowed(ap.Addr()) {
+				return errWebhookAddress
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: cfg.WebhookTimeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: cfg.WebhookTimeout,
+			MaxIdleConnsPerHost: 2,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+})
+
+// checkWebhookHost resolves host when a webhook is added, so that a URL the
+// client would refuse is reported straight away rather than in the delivery
+// log.
+func checkWebhookHost(ctx context.Context, host string) error {
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("cannot resolve %s", host)
+	}
+	for _, addr := range addrs {
+		if !webhookAddrAllowed(addr) {
+			return errWebhookAddress
+		}
+	}
+	return nil
+}
+
+// getUserWebhook loads the webhook named by the request's pk if it belongs to
+// the logged-in user.
+func getUserWebhook(w http.ResponseWriter, r *http.Request) (*Webhook, bool) {
+	pk, _ := strconv.ParseInt(gmux.Vars(r)["pk"], 10, 64)
+	obj, err := dbmap.Get(Webhook{}, pk)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	if obj == nil || obj.(*Webhook).Username != getStringFromSession(r, "User") {
+		http.NotFound(w, r)
+		return nil, false
+	}
+	return obj.(*Webhook), true
+}
+
+func registerWebhookRoutes(mux *router) {
+	mux.HandleFunc("/webhooks", func(w http.ResponseWriter, r *http.Request) {
+		hooks := []Webhook{}
+		if _, err := dbmap.Select(&hooks, "select * from webhooks where username="+dbmap.Dialect.BindVar(0)+
+			" order by pk", getStringFromSession(r, "User")); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(hooks); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}).Methods("GET")
+
+	mux.HandleFunc("/webhooks", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		u, err := url.ParseRequestURI(r.FormValue("url"))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			http.Error(w, "url must be an http or https URL", http.StatusBadRequest)
+			return
+		}
+		if err := checkWebhookHost(r.Context(), u.Hostname()); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		events := r.Form["events"]
+		if len(events) == 0 {
+			http.Error(w, "choose at least one event", http.StatusBadRequest)
+			return
+		}
+		for _, e := range events {
+			if !isWebhookEvent(e) {
+				http.Error(w, "unknown event "+strconv.Quote(e), http.StatusBadRequest)
+				return
+			}
+		}
+
+		hook := Webhook{
+			Username:  getStringFromSession(r, "User"),
+			URL:       u.String(),
+			Secret:    newWebhookSecret(),
+			Events:    strings.Join(events, ","),
+			CreatedAt: time.Now().Unix(),
+		}
+		if err := dbmap.Insert(&hook); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		recordAudit(dbmap, hook.Username, "webhook.create", 0, hook.URL)
+
+		if err := json.NewEncoder(w).Encode(hook); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}).Methods("POST")
+
+	mux.HandleFunc("/webhooks/{pk:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
+		hook, ok := getUserWebhook(w, r)
+		if !ok {
+			return
+		}
+		if _, err := dbmap.Exec("delete from webhook_deliveries where webhook_pk="+dbmap.Dialect.BindVar(0), hook.PK); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if _, err := dbmap.Delete(hook); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		recordAudit(dbmap, hook.Username, "webhook.delete", 0, hook.URL)
+		w.WriteHeader(http.StatusOK)
+	}).Methods("DELETE")
+
+	mux.HandleFunc("/webhooks/{pk:[0-9]+}/deliveries", func(w http.ResponseWriter, r *http.Request) {
+		hook, ok := getUserWebhook(w, r)
+		if !ok {
+			return
+		}
+		deliveries := []WebhookDelivery{}
+		if _, err := dbmap.Select(&deliveries, "select * from webhook_deliveries where webhook_pk="+dbmap.Dialect.BindVar(0)+
+			" order by pk desc limit 50", hook.PK); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(deliveries); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}).Methods("GET")
+
+	// Redelivering queues a fresh copy of the delivery, leaving the original
+	// and its outcome in the log.
+	mux.HandleFunc("/webhooks/{pk:[0-9]+}/deliveries/{delivery:[0-9]+}/redeliver", func(w http.ResponseWriter, r *http.Request) {
+		hook, ok := getUserWebhook(w, r)
+		if !ok {
+			return
+		}
+		pk, _ := strconv.ParseInt(gmux.Vars(r)["delivery"], 10, 64)
+		obj, err := dbmap.Get(WebhookDelivery{}, pk)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if obj == nil || obj.(*WebhookDelivery).WebhookPK != hook.PK {
+			http.NotFound(w, r)
+			return
+		}
+
+		now := time.Now().Unix()
+		d := *obj.(*WebhookDelivery)
+		d.PK, d.Status, d.Attempts, d.NextAttempt, d.LastAttempt = 0, deliveryPending, 0, now, 0
+		d.ResponseCode, d.Error, d.CreatedAt = 0, "", now
+		if err := dbmap.Insert(&d); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(d); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}).Methods("POST")
+
+	mux.HandleFunc("/settings/webhooks", func(w http.ResponseWriter, r *http.Request) {
+		p := WebhooksPage{Events: webhookEvents, User: getStringFromSession(r, "User")}
+		p.Theme = getPreferences(p.User).Theme
+		renderTemplate(w, "webhooks", p)
+	}).Methods("GET")
+}
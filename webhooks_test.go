@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignPayload(t *testing.T) {
+	tests := []struct {
+		secret string
+		body   string
+		want   string
+	}{
+		// RFC 4231, test case 2.
+		{"Jefe", "what do ya want for nothing?",
+			"sha256=5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"},
+		{"", "", "sha256=b613679a0814d9ec772f95d778c35fc5ff1697c493715653c6c712144292c5ad"},
+	}
+	for _, tt := range tests {
+		if got := signPayload(tt.secret, []byte(tt.body)); got != tt.want {
+			t.Errorf("signPayload(%q, %q) = %s, want %s", tt.secret, tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestIsPublicAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"127.1.2.3", false},
+		{"::1", false},
+		{"10.0.0.8", false},
+		{"172.16.5.4", false},
+		{"192.168.1.1", false},
+		{"fd00::1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"224.0.0.1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:169.254.169.254", false},
+	}
+	for _, tt := range tests {
+		if got := isPublicAddr(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("isPublicAddr(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestCheckWebhookHost(t *testing.T) {
+	for _, host := range []string{"127.0.0.1", "169.254.169.254", "::1", "10.1.2.3"} {
+		if err := checkWebhookHost(context.Background(), host); err != errWebhookAddress {
+			t.Errorf("checkWebhookHost(%q) = %v, want errWebhookAddress", host, err)
+		}
+	}
+	if err := checkWebhookHost(context.Background(), "93.184.216.34"); err != nil {
+		t.Errorf("checkWebhookHost of a public address: %v", err)
+	}
+}
+
+func TestSendWebhookRefusesInternalAddresses(t *testing.T) {
+	reached := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+	defer srv.Close()
+
+	hook := &Webhook{URL: srv.URL + "/metrics", Secret: "s"}
+	err := sendWebhook(hook, &WebhookDelivery{PK: 1, Event: "book.create", Payload: "{}"})
+	if err == nil || !strings.Contains(err.Error(), errWebhookAddress.Error()) {
+		t.Errorf("sendWebhook to %s: err = %v, want errWebhookAddress", srv.URL, err)
+	}
+	if reached {
+		t.Error("the request reached a loopback server")
+	}
+}
+
+// allowLoopbackWebhooks lets webhooks reach httptest servers for one test.
+func allowLoopbackWebhooks(t *testing.T) {
+	webhookAddrAllowed = func(addr netip.Addr) bool { return addr.IsLoopback() }
+	t.Cleanup(func() { webhookAddrAllowed = isPublicAddr })
+}
+
+func TestSendWebhook(t *testing.T) {
+	allowLoopbackWebhooks(t)
+
+	var got *http.Request
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	hook := &Webhook{URL: srv.URL, Secret: "s3cret"}
+	d := &WebhookDelivery{PK: 42, Event: "book.trash", Payload: `{"Event":"book.trash"}`}
+	if err := sendWebhook(hook, d); err != nil {
+		t.Fatalf("sendWebhook: %v", err)
+	}
+	if d.ResponseCode != http.StatusNoContent {
+		t.Errorf("ResponseCode = %d, want 204", d.ResponseCode)
+	}
+	if string(body) != d.Payload {
+		t.Errorf("body = %s, want %s", body, d.Payload)
+	}
+	headers := map[string]string{
+		"Content-Type":        "application/json",
+		"X-Webhook-Event":     "book.trash",
+		"X-Webhook-Delivery":  "42",
+		"X-Webhook-Signature": signPayload("s3cret", []byte(d.Payload)),
+	}
+	for name, want := range headers {
+		if v := got.Header.Get(name); v != want {
+			t.Errorf("%s = %q, want %q", name, v, want)
+		}
+	}
+}
+
+func TestSendWebhookRefusesRedirects(t *testing.T) {
+	allowLoopbackWebhooks(t)
+
+	followed := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/internal" {
+			followed = true
+			return
+		}
+		http.Redirect(w, r, "/internal", http.StatusFound)
+	}))
+	defer srv.Close()
+
+	d := &WebhookDelivery{PK: 1, Event: "book.create", Payload: "{}"}
+	if err := sendWebhook(&Webhook{URL: srv.URL, Secret: "s"}, d); err == nil {
+		t.Error("sendWebhook succeeded on a redirect")
+	}
+	if followed {
+		t.Error("the redirect was followed")
+	}
+	if d.ResponseCode != http.StatusFound {
+		t.Errorf("ResponseCode = %d, want 302", d.ResponseCode)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	saved := cfg
+	t.Cleanup(func() { cfg = saved })
+
+	tests := []struct {
+		backoff  time.Duration
+		attempts int
+		want     time.Duration
+	}{
+		{30 * time.Second, 1, 30 * time.Second},
+		{30 * time.Second, 2, time.Minute},
+		{30 * time.Second, 5, 8 * time.Minute},
+		{30 * time.Second, 20, maxWebhookBackoff},
+		{24 * time.Hour, 20, maxWebhookBackoff},
+		{1000 * time.Hour, 1, maxWebhookBackoff},
+	}
+	for _, tt := range tests {
+		cfg.WebhookBackoff = tt.backoff
+		if got := webhookBackoff(tt.attempts); got != tt.want {
+			t.Errorf("webhookBackoff(%d) with backoff %v = %v, want %v", tt.attempts, tt.backoff, got, tt.want)
+		}
+	}
+}